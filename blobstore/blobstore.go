@@ -0,0 +1,123 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	StorageSqlite = "sqlite"
+	StorageS3     = "s3"
+	StorageDisk   = "disk"
+)
+
+// ErrNotFound is returned whenever the data for a blob doesn't exist in the store
+var ErrNotFound = errors.New("blob not found")
+
+type BlobInfo struct {
+	Size int64
+}
+
+// Blobstore stores the contents of blobs. the blob rows themselves live in the blobs table and are managed by the
+// caller, a Blobstore only handles the bytes. the value of models.Blob.Storage is used to pick which store a blob lives
+// in
+type Blobstore interface {
+	// Put reads the blob from r and stores it, returning the cid and size of what was written. blob.ID and blob.Did need
+	// to be set, but blob.Cid won't be known yet
+	Put(ctx context.Context, blob *models.Blob, r io.Reader) (cid.Cid, int64, error)
+	Get(ctx context.Context, blob *models.Blob) (io.ReadCloser, error)
+	// GetRange reads length bytes of the blob starting at offset. the range has to be within the blob
+	GetRange(ctx context.Context, blob *models.Blob, offset, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, blob *models.Blob) error
+	Stat(ctx context.Context, blob *models.Blob) (*BlobInfo, error)
+	Exists(ctx context.Context, blob *models.Blob) (bool, error)
+}
+
+// StoredBlob describes a blob as it exists in a store, independent of any row in the blobs table
+type StoredBlob struct {
+	Did     string
+	Cid     cid.Cid
+	Size    int64
+	ModTime time.Time
+}
+
+// Lister is implemented by stores that can enumerate everything they hold. it's used to find data that no blob row
+// points at anymore. sqlite doesn't need it, since its parts are deleted along with their row, and in the same
+// transaction that migrates the row to another storage
+type Lister interface {
+	List(ctx context.Context, fn func(StoredBlob) error) error
+}
+
+// limitedReadCloser stops reading after a limit, but still closes the underlying reader
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newLimitedReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	return &limitedReadCloser{
+		Reader: io.LimitReader(rc, n),
+		Closer: rc,
+	}
+}
+
+// hashingReader computes the cid and size of everything that's read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{
+		r: r,
+		h: sha256.New(),
+	}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
+
+func (hr *hashingReader) Cid() (cid.Cid, error) {
+	mh, err := multihash.Encode(hr.h.Sum(nil), multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, mh), nil
+}
+
+// IsShared reports whether another blob row points at the same data as this one. the same blob can be uploaded more
+// than once, and since s3 and disk are content addressed, those rows all share the same object. its data can only be
+// removed once the last of them is gone. an upload that's still running doesn't have a cid yet, but it might be writing
+// this exact data again, so the data is treated as shared until it's done. like in Reconcile, anything that gets left
+// behind because of that is cleaned up by reconciling later
+func IsShared(ctx context.Context, dbw *db.DB, blob *models.Blob) (bool, error) {
+	// sqlite parts belong to a single blob row
+	if blob.Storage == StorageSqlite {
+		return false, nil
+	}
+
+	var count int64
+	if err := dbw.Raw(ctx, "SELECT COUNT(*) FROM blobs WHERE did = ? AND (cid = ? OR cid IS NULL) AND storage = ? AND id != ?", nil, blob.Did, blob.Cid, blob.Storage, blob.ID).Scan(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func blobCid(blob *models.Blob) (cid.Cid, error) {
+	return cid.Cast(blob.Cid)
+}
@@ -0,0 +1,199 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+)
+
+// DiskBlobstore keeps blobs as plain files on the local disk. files are content addressed, stored at
+// <dir>/blobs/<did>/<cid>
+type DiskBlobstore struct {
+	dir string
+}
+
+func NewDisk(dir string) (*DiskBlobstore, error) {
+	for _, d := range []string{filepath.Join(dir, "blobs"), filepath.Join(dir, "tmp")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("error creating blobstore directory: %w", err)
+		}
+	}
+
+	return &DiskBlobstore{
+		dir: dir,
+	}, nil
+}
+
+func (bs *DiskBlobstore) path(blob *models.Blob) (string, error) {
+	c, err := blobCid(blob)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(bs.dir, "blobs", blob.Did, c.String()), nil
+}
+
+func (bs *DiskBlobstore) Put(ctx context.Context, blob *models.Blob, r io.Reader) (cid.Cid, int64, error) {
+	// write to a temporary file first. once we know the cid we can rename it into place, so a blob's path only ever
+	// contains a complete file
+	f, err := os.CreateTemp(filepath.Join(bs.dir, "tmp"), "blob-*")
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hr := newHashingReader(r)
+	if _, err := io.Copy(f, hr); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	c, err := hr.Cid()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	dir := filepath.Join(bs.dir, "blobs", blob.Did)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(dir, c.String())); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	return c, hr.n, nil
+}
+
+func (bs *DiskBlobstore) Get(ctx context.Context, blob *models.Blob) (io.ReadCloser, error) {
+	p, err := bs.path(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (bs *DiskBlobstore) GetRange(ctx context.Context, blob *models.Blob, offset, length int64) (io.ReadCloser, error) {
+	rc, err := bs.Get(ctx, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	f := rc.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return newLimitedReadCloser(f, length), nil
+}
+
+func (bs *DiskBlobstore) Delete(ctx context.Context, blob *models.Blob) error {
+	p, err := bs.path(blob)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (bs *DiskBlobstore) Stat(ctx context.Context, blob *models.Blob) (*BlobInfo, error) {
+	p, err := bs.path(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &BlobInfo{Size: fi.Size()}, nil
+}
+
+func (bs *DiskBlobstore) Exists(ctx context.Context, blob *models.Blob) (bool, error) {
+	if _, err := bs.Stat(ctx, blob); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (bs *DiskBlobstore) List(ctx context.Context, fn func(StoredBlob) error) error {
+	root := filepath.Join(bs.dir, "blobs")
+
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		// anything that doesn't look like <did>/<cid> wasn't put there by us, so leave it alone
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		did, name := filepath.Split(rel)
+		did = filepath.Clean(did)
+		if did == "." || filepath.Dir(did) != "." {
+			return nil
+		}
+
+		c, err := cid.Parse(name)
+		if err != nil {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(StoredBlob{
+			Did:     did,
+			Cid:     c,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	})
+}
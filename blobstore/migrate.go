@@ -0,0 +1,163 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+)
+
+const (
+	migrateBatchSize = 100
+)
+
+type MigrateArgs struct {
+	From      string
+	FromStore Blobstore
+	To        string
+	ToStore   Blobstore
+
+	// Did limits the migration to a single repo if set
+	Did string
+
+	// DryRun only reports what would be migrated without copying or deleting anything
+	DryRun bool
+
+	Logger *slog.Logger
+}
+
+type MigrateResult struct {
+	Migrated int
+	Failed   int
+	Bytes    int64
+}
+
+// Migrate copies every blob in one storage over to another. each blob is verified against its cid once copied, then
+// its row is pointed at the new storage and the source data is removed. blobs are handled one at a time, so an
+// interrupted migration can simply be run again to pick up where it left off
+func Migrate(ctx context.Context, dbw *db.DB, args MigrateArgs) (*MigrateResult, error) {
+	if args.From == args.To {
+		return nil, fmt.Errorf("source and destination storage are the same")
+	}
+
+	if args.Logger == nil {
+		args.Logger = slog.Default()
+	}
+
+	res := &MigrateResult{}
+
+	var lastID uint
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		var blobs []models.Blob
+		q := "SELECT * FROM blobs WHERE storage = ? AND cid IS NOT NULL AND id > ?"
+		qargs := []any{args.From, lastID}
+		if args.Did != "" {
+			q += " AND did = ?"
+			qargs = append(qargs, args.Did)
+		}
+		q += " ORDER BY id ASC LIMIT ?"
+		qargs = append(qargs, migrateBatchSize)
+
+		if err := dbw.Raw(ctx, q, nil, qargs...).Scan(&blobs).Error; err != nil {
+			return res, fmt.Errorf("error getting blobs: %w", err)
+		}
+
+		for _, blob := range blobs {
+			lastID = blob.ID
+
+			size, err := migrateBlob(ctx, dbw, args, &blob)
+			if err != nil {
+				args.Logger.Error("error migrating blob", "id", blob.ID, "did", blob.Did, "error", err)
+				res.Failed++
+				continue
+			}
+
+			res.Migrated++
+			res.Bytes += size
+		}
+
+		if len(blobs) < migrateBatchSize {
+			return res, nil
+		}
+	}
+}
+
+func migrateBlob(ctx context.Context, dbw *db.DB, args MigrateArgs, blob *models.Blob) (int64, error) {
+	expected, err := blobCid(blob)
+	if err != nil {
+		return 0, err
+	}
+
+	if args.DryRun {
+		info, err := args.FromStore.Stat(ctx, blob)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size, nil
+	}
+
+	rc, err := args.FromStore.Get(ctx, blob)
+	if err != nil {
+		return 0, fmt.Errorf("error reading blob: %w", err)
+	}
+	defer rc.Close()
+
+	dst := *blob
+	dst.Storage = args.To
+
+	c, size, err := args.ToStore.Put(ctx, &dst, rc)
+	if err != nil {
+		return 0, fmt.Errorf("error writing blob: %w", err)
+	}
+
+	if !c.Equals(expected) {
+		// the copy doesn't match, so get rid of it. it was written under the cid we computed, not the one in the row
+		bad := dst
+		bad.Cid = c.Bytes()
+		if err := args.ToStore.Delete(ctx, &bad); err != nil {
+			args.Logger.Warn("error removing mismatched copy", "id", blob.ID, "error", err)
+		}
+		return 0, fmt.Errorf("cid mismatch after copy, expected %s but got %s", expected, c)
+	}
+
+	// sqlite parts belong to a single row, so they can be removed in the same transaction that moves the row. otherwise a
+	// crash in between would leave parts behind that reconcile can't find, since they're keyed by the row's id
+	if _, ok := args.FromStore.(*SqliteBlobstore); ok {
+		if err := dbw.Transaction(ctx, func(tx *db.DB) error {
+			if err := tx.Exec(ctx, "UPDATE blobs SET storage = ? WHERE id = ? AND storage = ?", nil, args.To, blob.ID, args.From).Error; err != nil {
+				return err
+			}
+
+			return NewSqlite(tx).Delete(ctx, blob)
+		}); err != nil {
+			return 0, fmt.Errorf("error updating blob storage: %w", err)
+		}
+
+		return size, nil
+	}
+
+	if err := dbw.Exec(ctx, "UPDATE blobs SET storage = ? WHERE id = ? AND storage = ?", nil, args.To, blob.ID, args.From).Error; err != nil {
+		return 0, fmt.Errorf("error updating blob storage: %w", err)
+	}
+
+	// other rows for the same blob might still be waiting to be migrated, and they need the source data until then
+	shared, err := IsShared(ctx, dbw, blob)
+	if err != nil {
+		return 0, err
+	}
+
+	if !shared {
+		if err := args.FromStore.Delete(ctx, blob); err != nil {
+			// the blob has already been moved, so this only leaves some garbage behind
+			args.Logger.Warn("error removing source data after migrating", "id", blob.ID, "error", err)
+		}
+	}
+
+	return size, nil
+}
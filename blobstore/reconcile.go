@@ -0,0 +1,90 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+)
+
+type ReconcileArgs struct {
+	Storage string
+	Store   Lister
+
+	// MinAge skips anything that was written more recently than this. an upload writes its data before the row is
+	// updated with the cid, and a migration copies data before moving the row over, so fresh data can look orphaned
+	// for a moment
+	MinAge time.Duration
+
+	// DryRun only reports the orphaned data without deleting it
+	DryRun bool
+
+	Logger *slog.Logger
+}
+
+type ReconcileResult struct {
+	Checked int
+	Orphans int
+	Failed  int
+	Bytes   int64
+}
+
+// Reconcile finds data in a store that no blob row points at anymore and deletes it. normally data is removed as soon as
+// its row is, but a delete that kept failing or a crash at the wrong moment can leave some behind
+func Reconcile(ctx context.Context, dbw *db.DB, args ReconcileArgs) (*ReconcileResult, error) {
+	if args.Logger == nil {
+		args.Logger = slog.Default()
+	}
+
+	store, ok := args.Store.(Blobstore)
+	if !ok {
+		return nil, fmt.Errorf("%s storage can't delete blobs", args.Storage)
+	}
+
+	res := &ReconcileResult{}
+	cutoff := time.Now().Add(-args.MinAge)
+
+	if err := args.Store.List(ctx, func(sb StoredBlob) error {
+		res.Checked++
+
+		if sb.ModTime.After(cutoff) {
+			return nil
+		}
+
+		// an upload that's still running has a row without a cid yet, and it might be writing this exact data again. leave
+		// the repo's data alone until it's done, the next run will get to it
+		var count int64
+		if err := dbw.Raw(ctx, "SELECT COUNT(*) FROM blobs WHERE did = ? AND (cid = ? OR cid IS NULL) AND storage = ?", nil, sb.Did, sb.Cid.Bytes(), args.Storage).Scan(&count).Error; err != nil {
+			return fmt.Errorf("error checking for blob rows: %w", err)
+		}
+
+		if count > 0 {
+			return nil
+		}
+
+		res.Orphans++
+		res.Bytes += sb.Size
+
+		if args.DryRun {
+			args.Logger.Info("found orphaned blob", "did", sb.Did, "cid", sb.Cid, "size", sb.Size)
+			return nil
+		}
+
+		if err := store.Delete(ctx, &models.Blob{Did: sb.Did, Cid: sb.Cid.Bytes(), Storage: args.Storage}); err != nil {
+			args.Logger.Error("error deleting orphaned blob", "did", sb.Did, "cid", sb.Cid, "error", err)
+			res.Failed++
+			return nil
+		}
+
+		args.Logger.Info("deleted orphaned blob", "did", sb.Did, "cid", sb.Cid, "size", sb.Size)
+
+		return nil
+	}); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
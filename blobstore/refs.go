@@ -0,0 +1,90 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	recountBatchSize = 500
+)
+
+// RecordBlobCids returns the cids of every blob referenced in a cbor encoded record. a record that references the same
+// blob more than once only holds a single ref to it
+func RecordBlobCids(value []byte) ([]cid.Cid, error) {
+	decoded, err := atdata.UnmarshalCBOR(value)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling cbor: %w", err)
+	}
+
+	var cids []cid.Cid
+	seen := map[cid.Cid]struct{}{}
+	for _, b := range atdata.ExtractBlobs(decoded) {
+		c := cid.Cid(b.Ref)
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		cids = append(cids, c)
+	}
+
+	return cids, nil
+}
+
+// RecountRefs rederives the ref count of every blob in a repo from the records that reference them, and marks the repo as
+// counted. nothing else can be writing to the repo while this runs
+func RecountRefs(ctx context.Context, dbw *db.DB, did string) (int, error) {
+	counts := map[cid.Cid]int{}
+
+	var lastNsid, lastRkey string
+	for {
+		var records []models.Record
+		if err := dbw.Raw(ctx, "SELECT nsid, rkey, value FROM records WHERE did = ? AND (nsid > ? OR (nsid = ? AND rkey > ?)) ORDER BY nsid ASC, rkey ASC LIMIT ?", nil, did, lastNsid, lastNsid, lastRkey, recountBatchSize).Scan(&records).Error; err != nil {
+			return 0, fmt.Errorf("error getting records: %w", err)
+		}
+
+		for _, rec := range records {
+			lastNsid, lastRkey = rec.Nsid, rec.Rkey
+
+			if len(rec.Value) == 0 {
+				continue
+			}
+
+			cids, err := RecordBlobCids(rec.Value)
+			if err != nil {
+				return 0, fmt.Errorf("error reading blobs from %s/%s: %w", rec.Nsid, rec.Rkey, err)
+			}
+
+			for _, c := range cids {
+				counts[c]++
+			}
+		}
+
+		if len(records) < recountBatchSize {
+			break
+		}
+	}
+
+	if err := dbw.Transaction(ctx, func(tx *db.DB) error {
+		if err := tx.Exec(ctx, "UPDATE blobs SET ref_count = 0 WHERE did = ?", nil, did).Error; err != nil {
+			return err
+		}
+
+		for c, n := range counts {
+			if err := tx.Exec(ctx, "UPDATE blobs SET ref_count = ? WHERE did = ? AND cid = ?", nil, n, did, c.Bytes()).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec(ctx, "UPDATE repos SET blob_refs_counted = ? WHERE did = ?", nil, true, did).Error
+	}); err != nil {
+		return 0, fmt.Errorf("error updating ref counts: %w", err)
+	}
+
+	return len(counts), nil
+}
@@ -0,0 +1,214 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+)
+
+// S3Blobstore keeps blobs in an s3 compatible bucket, under blobs/<did>/<cid>
+type S3Blobstore struct {
+	svc    *s3.S3
+	bucket string
+}
+
+func NewS3(svc *s3.S3, bucket string) *S3Blobstore {
+	return &S3Blobstore{
+		svc:    svc,
+		bucket: bucket,
+	}
+}
+
+// S3Key returns the key that a blob is stored under
+func S3Key(did string, c cid.Cid) string {
+	return fmt.Sprintf("blobs/%s/%s", did, c.String())
+}
+
+func (bs *S3Blobstore) Put(ctx context.Context, blob *models.Blob, r io.Reader) (cid.Cid, int64, error) {
+	hr := newHashingReader(r)
+
+	// we don't know the cid until the whole body has been read, so upload under a temporary key first and move it into
+	// place afterwards. the uploader switches over to a multipart upload for anything bigger than one part
+	tmpKey := fmt.Sprintf("tmp/%s/%d", blob.Did, blob.ID)
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(bs.bucket),
+		Key:    aws.String(tmpKey),
+		Body:   hr,
+	}
+
+	// the content type is carried over by the copy below, so blobs get served with it when they're fetched from a cdn
+	if blob.MimeType != "" {
+		input.ContentType = aws.String(blob.MimeType)
+	}
+
+	if _, err := s3manager.NewUploaderWithClient(bs.svc).UploadWithContext(ctx, input); err != nil {
+		return cid.Undef, 0, fmt.Errorf("error uploading blob: %w", err)
+	}
+
+	// whatever happens below, the temporary object isn't needed anymore
+	defer bs.svc.DeleteObjectWithContext(context.WithoutCancel(ctx), &s3.DeleteObjectInput{
+		Bucket: aws.String(bs.bucket),
+		Key:    aws.String(tmpKey),
+	})
+
+	c, err := hr.Cid()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if _, err := bs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bs.bucket),
+		CopySource: aws.String(url.PathEscape(bs.bucket + "/" + tmpKey)),
+		Key:        aws.String(S3Key(blob.Did, c)),
+	}); err != nil {
+		return cid.Undef, 0, fmt.Errorf("error moving blob into place: %w", err)
+	}
+
+	return c, hr.n, nil
+}
+
+func (bs *S3Blobstore) Get(ctx context.Context, blob *models.Blob) (io.ReadCloser, error) {
+	c, err := blobCid(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := bs.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bs.bucket),
+		Key:    aws.String(S3Key(blob.Did, c)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (bs *S3Blobstore) GetRange(ctx context.Context, blob *models.Blob, offset, length int64) (io.ReadCloser, error) {
+	c, err := blobCid(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty range can't be expressed as a range header, and there's nothing to fetch anyway
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	res, err := bs.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bs.bucket),
+		Key:    aws.String(S3Key(blob.Did, c)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (bs *S3Blobstore) Delete(ctx context.Context, blob *models.Blob) error {
+	c, err := blobCid(blob)
+	if err != nil {
+		return err
+	}
+
+	_, err = bs.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bs.bucket),
+		Key:    aws.String(S3Key(blob.Did, c)),
+	})
+	return err
+}
+
+func (bs *S3Blobstore) Stat(ctx context.Context, blob *models.Blob) (*BlobInfo, error) {
+	c, err := blobCid(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := bs.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bs.bucket),
+		Key:    aws.String(S3Key(blob.Did, c)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &BlobInfo{Size: aws.Int64Value(res.ContentLength)}, nil
+}
+
+func (bs *S3Blobstore) Exists(ctx context.Context, blob *models.Blob) (bool, error) {
+	if _, err := bs.Stat(ctx, blob); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (bs *S3Blobstore) List(ctx context.Context, fn func(StoredBlob) error) error {
+	var ferr error
+	if err := bs.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bs.bucket),
+		Prefix: aws.String("blobs/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			// anything that doesn't look like blobs/<did>/<cid> wasn't put there by us, so leave it alone
+			pts := strings.Split(strings.TrimPrefix(aws.StringValue(obj.Key), "blobs/"), "/")
+			if len(pts) != 2 {
+				continue
+			}
+
+			c, err := cid.Parse(pts[1])
+			if err != nil {
+				continue
+			}
+
+			if ferr = fn(StoredBlob{
+				Did:     pts[0],
+				Cid:     c,
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			}); ferr != nil {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	return ferr
+}
+
+func isS3NotFound(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+)
+
+const backfillSizesBatchSize = 500
+
+type BackfillSizesArgs struct {
+	// Stores are the blobstores to read sizes from, keyed by storage. blobs in any other storage are skipped
+	Stores map[string]Blobstore
+
+	Logger *slog.Logger
+}
+
+type BackfillSizesResult struct {
+	Checked int
+	Updated int
+	Missing int
+	Failed  int
+}
+
+// BackfillSizes fills in the size of finished blobs that were uploaded before sizes were stored, by reading it from
+// their storage. those rows have a size of 0, which would leave them out of every account's storage usage. a blob that
+// really is empty gets checked again on every run, but there's nothing to update for it
+func BackfillSizes(ctx context.Context, dbw *db.DB, args BackfillSizesArgs) (*BackfillSizesResult, error) {
+	if args.Logger == nil {
+		args.Logger = slog.Default()
+	}
+
+	res := &BackfillSizesResult{}
+
+	var lastID uint
+	for {
+		var blobs []models.Blob
+		if err := dbw.Raw(ctx, "SELECT id, did, cid, storage FROM blobs WHERE size = 0 AND cid IS NOT NULL AND id > ? ORDER BY id ASC LIMIT ?", nil, lastID, backfillSizesBatchSize).Scan(&blobs).Error; err != nil {
+			return nil, fmt.Errorf("error getting blobs: %w", err)
+		}
+
+		for _, blob := range blobs {
+			lastID = blob.ID
+			res.Checked++
+
+			store, ok := args.Stores[blob.Storage]
+			if !ok {
+				args.Logger.Error("can't backfill the size of a blob in a storage that isn't enabled", "did", blob.Did, "storage", blob.Storage)
+				res.Failed++
+				continue
+			}
+
+			info, err := store.Stat(ctx, &blob)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					res.Missing++
+					continue
+				}
+				args.Logger.Error("error getting blob size", "did", blob.Did, "id", blob.ID, "error", err)
+				res.Failed++
+				continue
+			}
+
+			if info.Size == 0 {
+				continue
+			}
+
+			// the size check keeps us from overwriting a row that was changed since we read it
+			if err := dbw.Exec(ctx, "UPDATE blobs SET size = ? WHERE id = ? AND size = 0", nil, info.Size, blob.ID).Error; err != nil {
+				return nil, fmt.Errorf("error updating blob size: %w", err)
+			}
+			res.Updated++
+		}
+
+		if len(blobs) < backfillSizesBatchSize {
+			break
+		}
+	}
+
+	return res, nil
+}
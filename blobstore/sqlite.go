@@ -0,0 +1,197 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// blobs are split into parts of this size in the blob_parts table
+	SqlitePartSize = 0x10000
+)
+
+// SqliteBlobstore keeps blobs in the database, split into fixed size parts in the blob_parts table
+type SqliteBlobstore struct {
+	db *db.DB
+}
+
+func NewSqlite(db *db.DB) *SqliteBlobstore {
+	return &SqliteBlobstore{
+		db: db,
+	}
+}
+
+func (bs *SqliteBlobstore) Put(ctx context.Context, blob *models.Blob, r io.Reader) (cid.Cid, int64, error) {
+	// clear out anything left behind by an earlier put that didn't finish, so that we don't conflict with its parts
+	if err := bs.Delete(ctx, blob); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	hr := newHashingReader(r)
+
+	buf := make([]byte, SqlitePartSize)
+	part := 0
+
+	for {
+		n, err := io.ReadFull(hr, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return cid.Undef, 0, err
+		}
+
+		blobPart := models.BlobPart{
+			BlobID: blob.ID,
+			Idx:    part,
+			Data:   buf[:n],
+		}
+
+		if err := bs.db.Create(ctx, &blobPart, nil).Error; err != nil {
+			return cid.Undef, 0, err
+		}
+		part++
+
+		if n < SqlitePartSize {
+			break
+		}
+	}
+
+	// empty blobs still get a single empty part, so that we can tell them apart from blobs that don't exist
+	if part == 0 {
+		if err := bs.db.Create(ctx, &models.BlobPart{BlobID: blob.ID, Idx: 0, Data: []byte{}}, nil).Error; err != nil {
+			return cid.Undef, 0, err
+		}
+	}
+
+	c, err := hr.Cid()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	return c, hr.n, nil
+}
+
+func (bs *SqliteBlobstore) Get(ctx context.Context, blob *models.Blob) (io.ReadCloser, error) {
+	r := &sqlitePartReader{
+		ctx:    ctx,
+		db:     bs.db,
+		blobID: blob.ID,
+	}
+
+	// read the first part up front so that missing blobs are reported here rather than partway through a response
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	if r.done && r.idx == 0 {
+		return nil, ErrNotFound
+	}
+
+	return r, nil
+}
+
+func (bs *SqliteBlobstore) GetRange(ctx context.Context, blob *models.Blob, offset, length int64) (io.ReadCloser, error) {
+	// every part but the last is exactly SqlitePartSize, so we can jump straight to the part that holds the offset
+	start := int(offset / SqlitePartSize)
+	r := &sqlitePartReader{
+		ctx:    ctx,
+		db:     bs.db,
+		blobID: blob.ID,
+		idx:    start,
+	}
+
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	if r.done && r.idx == start {
+		return nil, ErrNotFound
+	}
+
+	r.curr = r.curr[min(offset%SqlitePartSize, int64(len(r.curr))):]
+
+	return newLimitedReadCloser(r, length), nil
+}
+
+func (bs *SqliteBlobstore) Delete(ctx context.Context, blob *models.Blob) error {
+	return bs.db.Exec(ctx, "DELETE FROM blob_parts WHERE blob_id = ?", nil, blob.ID).Error
+}
+
+func (bs *SqliteBlobstore) Stat(ctx context.Context, blob *models.Blob) (*BlobInfo, error) {
+	var res struct {
+		Parts int64
+		Size  int64
+	}
+	if err := bs.db.Raw(ctx, "SELECT COUNT(*) AS parts, COALESCE(SUM(LENGTH(data)), 0) AS size FROM blob_parts WHERE blob_id = ?", nil, blob.ID).Scan(&res).Error; err != nil {
+		return nil, err
+	}
+
+	if res.Parts == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &BlobInfo{Size: res.Size}, nil
+}
+
+func (bs *SqliteBlobstore) Exists(ctx context.Context, blob *models.Blob) (bool, error) {
+	var count int64
+	if err := bs.db.Raw(ctx, "SELECT COUNT(*) FROM blob_parts WHERE blob_id = ?", nil, blob.ID).Scan(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// sqlitePartReader reads a blob one part at a time, so that we only ever hold a single part in memory
+type sqlitePartReader struct {
+	ctx    context.Context
+	db     *db.DB
+	blobID uint
+	idx    int
+	curr   []byte
+	done   bool
+}
+
+func (r *sqlitePartReader) Read(p []byte) (int, error) {
+	for len(r.curr) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.curr)
+	r.curr = r.curr[n:]
+	return n, nil
+}
+
+// next loads the next part into curr, or marks the reader as done if there are no more parts
+func (r *sqlitePartReader) next() error {
+	var part models.BlobPart
+	res := r.db.Raw(r.ctx, "SELECT * FROM blob_parts WHERE blob_id = ? AND idx = ?", nil, r.blobID, r.idx).Scan(&part)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		r.done = true
+		return nil
+	}
+
+	r.curr = part.Data
+	r.idx++
+
+	// the last part is the only one that can be short, so we can stop here without another query
+	if len(part.Data) < SqlitePartSize {
+		r.done = true
+	}
+
+	return nil
+}
+
+func (r *sqlitePartReader) Close() error {
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/server"
+	"github.com/urfave/cli/v2"
+)
+
+var runBlobs = &cli.Command{
+	Name:  "blobs",
+	Usage: "blob storage commands",
+	Subcommands: []*cli.Command{
+		runBlobsMigrate,
+		runBlobsReconcile,
+		runBlobsRecountRefs,
+		runBlobsSetQuota,
+	},
+}
+
+var runBlobsMigrate = &cli.Command{
+	Name:  "migrate",
+	Usage: "moves blobs from one storage backend to another. can be safely run again if interrupted",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "from",
+			Required: true,
+			Usage:    "storage to move blobs out of (sqlite, s3 or disk)",
+		},
+		&cli.StringFlag{
+			Name:     "to",
+			Required: true,
+			Usage:    "storage to move blobs into (sqlite, s3 or disk)",
+		},
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "optional did to only migrate the blobs of a single repo",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "report what would be migrated without changing anything",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		from, err := newBlobstore(cmd, dbw, cmd.String("from"))
+		if err != nil {
+			return err
+		}
+
+		to, err := newBlobstore(cmd, dbw, cmd.String("to"))
+		if err != nil {
+			return err
+		}
+
+		res, err := blobstore.Migrate(cmd.Context, dbw, blobstore.MigrateArgs{
+			From:      cmd.String("from"),
+			FromStore: from,
+			To:        cmd.String("to"),
+			ToStore:   to,
+			Did:       cmd.String("did"),
+			DryRun:    cmd.Bool("dry-run"),
+		})
+		if err != nil {
+			return err
+		}
+
+		if cmd.Bool("dry-run") {
+			fmt.Printf("Would migrate %d blobs (%d bytes) from %s to %s, %d blobs could not be read\n", res.Migrated, res.Bytes, cmd.String("from"), cmd.String("to"), res.Failed)
+		} else {
+			fmt.Printf("Migrated %d blobs (%d bytes) from %s to %s, %d failed\n", res.Migrated, res.Bytes, cmd.String("from"), cmd.String("to"), res.Failed)
+		}
+
+		return nil
+	},
+}
+
+var runBlobsReconcile = &cli.Command{
+	Name:  "reconcile",
+	Usage: "deletes blob data in s3 or on disk that no blob row points at anymore",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "storage",
+			Required: true,
+			Usage:    "storage to reconcile (s3 or disk)",
+		},
+		&cli.DurationFlag{
+			Name:  "min-age",
+			Value: 24 * time.Hour,
+			Usage: "only delete data older than this, so in-flight uploads and migrations are left alone",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "report orphaned data without deleting it",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		bs, err := newBlobstore(cmd, dbw, cmd.String("storage"))
+		if err != nil {
+			return err
+		}
+
+		lister, ok := bs.(blobstore.Lister)
+		if !ok {
+			return fmt.Errorf("%s storage doesn't need to be reconciled", cmd.String("storage"))
+		}
+
+		res, err := blobstore.Reconcile(cmd.Context, dbw, blobstore.ReconcileArgs{
+			Storage: cmd.String("storage"),
+			Store:   lister,
+			MinAge:  cmd.Duration("min-age"),
+			DryRun:  cmd.Bool("dry-run"),
+		})
+		if err != nil {
+			return err
+		}
+
+		if cmd.Bool("dry-run") {
+			fmt.Printf("Checked %d blobs, found %d orphaned blobs (%d bytes)\n", res.Checked, res.Orphans, res.Bytes)
+		} else {
+			fmt.Printf("Checked %d blobs, found %d orphaned blobs (%d bytes), %d could not be deleted\n", res.Checked, res.Orphans, res.Bytes, res.Failed)
+		}
+
+		return nil
+	},
+}
+
+var runBlobsRecountRefs = &cli.Command{
+	Name:  "recount-refs",
+	Usage: "rederives blob ref counts from the records that reference them. stop the pds before running this",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "optional did of a single repo to recount. all repos are recounted if not set",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		dids, err := repoDids(cmd, dbw)
+		if err != nil {
+			return err
+		}
+
+		for _, did := range dids {
+			n, err := blobstore.RecountRefs(cmd.Context, dbw, did)
+			if err != nil {
+				return fmt.Errorf("error recounting blob refs for %s: %w", did, err)
+			}
+
+			fmt.Printf("%s: %d referenced blobs\n", did, n)
+		}
+
+		return nil
+	},
+}
+
+var runBlobsSetQuota = &cli.Command{
+	Name:  "set-quota",
+	Usage: "overrides the blob storage quota of a single account",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "did",
+			Required: true,
+			Usage:    "did of the account to set the quota for",
+		},
+		&cli.Int64Flag{
+			Name:  "quota",
+			Usage: "quota in bytes. zero means unlimited",
+		},
+		&cli.BoolFlag{
+			Name:  "default",
+			Usage: "remove the override, so the account goes back to the default quota",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		did, err := syntax.ParseDID(cmd.String("did"))
+		if err != nil {
+			return err
+		}
+
+		var quota *int64
+		if !cmd.Bool("default") {
+			if !cmd.IsSet("quota") {
+				return fmt.Errorf("either --quota or --default must be set")
+			}
+			q := cmd.Int64("quota")
+			if q < 0 {
+				return fmt.Errorf("quota can't be negative")
+			}
+			quota = &q
+		}
+
+		res := dbw.Exec(cmd.Context, "UPDATE repos SET blob_quota = ? WHERE did = ?", nil, quota, did.String())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("no account found for %s", did.String())
+		}
+
+		if quota == nil {
+			fmt.Printf("Blob quota for %s reset to the default\n", did.String())
+		} else {
+			fmt.Printf("Blob quota for %s set to %d bytes\n", did.String(), *quota)
+		}
+
+		return nil
+	},
+}
+
+// newBlobstore creates a blobstore from the same flags that the server uses
+func newBlobstore(cmd *cli.Context, dbw *db.DB, storage string) (blobstore.Blobstore, error) {
+	switch storage {
+	case blobstore.StorageSqlite:
+		return blobstore.NewSqlite(dbw), nil
+	case blobstore.StorageDisk:
+		if cmd.String("disk-blobstore-path") == "" {
+			return nil, fmt.Errorf("COCOON_DISK_BLOBSTORE_PATH must be set to use disk storage")
+		}
+		return blobstore.NewDisk(cmd.String("disk-blobstore-path"))
+	case blobstore.StorageS3:
+		cfg := &server.S3Config{
+			Region:    cmd.String("s3-region"),
+			Bucket:    cmd.String("s3-bucket"),
+			Endpoint:  cmd.String("s3-endpoint"),
+			AccessKey: cmd.String("s3-access-key"),
+			SecretKey: cmd.String("s3-secret-key"),
+		}
+		if cfg.Bucket == "" {
+			return nil, fmt.Errorf("COCOON_S3_BUCKET must be set to use s3 storage")
+		}
+
+		sess, err := server.NewS3Session(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return blobstore.NewS3(s3.New(sess), cfg.Bucket), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", storage)
+	}
+}
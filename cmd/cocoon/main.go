@@ -11,8 +11,10 @@ import (
 
 	"github.com/bluesky-social/indigo/atproto/atcrypto"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/image_sanitizer"
 	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/haileyok/cocoon/server"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/urfave/cli/v2"
@@ -116,6 +118,11 @@ func main() {
 				Name:    "s3-blobstore-enabled",
 				EnvVars: []string{"COCOON_S3_BLOBSTORE_ENABLED"},
 			},
+			&cli.StringFlag{
+				Name:    "disk-blobstore-path",
+				EnvVars: []string{"COCOON_DISK_BLOBSTORE_PATH"},
+				Usage:   "Directory to store blobs in on the local disk. Ignored for new blobs if the S3 blobstore is enabled.",
+			},
 			&cli.StringFlag{
 				Name:    "s3-region",
 				EnvVars: []string{"COCOON_S3_REGION"},
@@ -150,10 +157,96 @@ func main() {
 				EnvVars: []string{"COCOON_BLOCKSTORE_VARIANT"},
 				Value:   "sqlite",
 			},
+			&cli.Int64Flag{
+				Name:    "block-cache-size",
+				EnvVars: []string{"COCOON_BLOCK_CACHE_SIZE"},
+				Usage:   "How many bytes of repo blocks to keep cached in memory. Set to 0 to disable the cache",
+				Value:   sqlite_blockstore.DefaultCacheSize,
+			},
+			&cli.DurationFlag{
+				Name:    "repo-compact-interval",
+				EnvVars: []string{"COCOON_REPO_COMPACT_INTERVAL"},
+				Usage:   "How often blocks that are no longer reachable from a repo's root are deleted. 0 (the default) disables compaction. Compaction saves space, but history older than repo-history-retention is lost, and repo backfill-revs can no longer rederive the block revs that getRepo since relies on from it. Run backfill-revs before turning this on",
+				Value:   0,
+			},
+			&cli.DurationFlag{
+				Name:    "repo-history-retention",
+				EnvVars: []string{"COCOON_REPO_HISTORY_RETENTION"},
+				Usage:   "How much repo history compaction keeps around",
+				Value:   time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "import-spool-dir",
+				EnvVars: []string{"COCOON_IMPORT_SPOOL_DIR"},
+				Usage:   "Directory that repo cars are kept in while they wait to be imported in the background",
+				Value:   "imports",
+			},
+			&cli.Int64Flag{
+				Name:    "import-max-size",
+				EnvVars: []string{"COCOON_IMPORT_MAX_SIZE"},
+				Usage:   "Largest car in bytes that can be uploaded for a repo import",
+				Value:   server.DefaultImportMaxSize,
+			},
 			&cli.StringFlag{
 				Name:    "fallback-proxy",
 				EnvVars: []string{"COCOON_FALLBACK_PROXY"},
 			},
+			&cli.DurationFlag{
+				Name:    "events-backfill-window",
+				EnvVars: []string{"COCOON_EVENTS_BACKFILL_WINDOW"},
+				Usage:   "How long firehose events are kept around for subscribeRepos cursor replay",
+				Value:   72 * time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:    "blob-gc-grace-period",
+				EnvVars: []string{"COCOON_BLOB_GC_GRACE_PERIOD"},
+				Usage:   "How long an uploaded blob can go without being referenced by a record before it is deleted",
+				Value:   time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:    "blob-reconcile-interval",
+				EnvVars: []string{"COCOON_BLOB_RECONCILE_INTERVAL"},
+				Usage:   "How often blob data in s3 or on disk that no blob row points at anymore is deleted. Set to 0 to disable reconciling",
+				Value:   24 * time.Hour,
+			},
+			&cli.Int64Flag{
+				Name:    "blob-max-size",
+				EnvVars: []string{"COCOON_BLOB_MAX_SIZE"},
+				Usage:   "Largest blob in bytes that can be uploaded",
+				Value:   server.DefaultBlobMaxSize,
+			},
+			&cli.StringSliceFlag{
+				Name:    "blob-mime-limit",
+				EnvVars: []string{"COCOON_BLOB_MIME_LIMITS"},
+				Usage:   "Size limits in bytes for specific mime types, like image/*=1000000 or video/mp4=100000000",
+			},
+			&cli.Int64Flag{
+				Name:    "blob-quota",
+				EnvVars: []string{"COCOON_BLOB_QUOTA"},
+				Usage:   "Total blob storage in bytes that each account gets. Zero means unlimited. Can be overridden per account with `cocoon blobs set-quota`",
+			},
+			&cli.BoolFlag{
+				Name:    "blob-image-processing",
+				EnvVars: []string{"COCOON_BLOB_IMAGE_PROCESSING"},
+				Usage:   "Strip metadata like EXIF out of uploaded images, and reject images that are corrupt or too large to decode",
+			},
+			&cli.Int64Flag{
+				Name:    "blob-image-max-pixels",
+				EnvVars: []string{"COCOON_BLOB_IMAGE_MAX_PIXELS"},
+				Usage:   "Largest width * height that an uploaded image can have when image processing is enabled",
+				Value:   image_sanitizer.DefaultMaxPixels,
+			},
+			&cli.IntFlag{
+				Name:    "blob-image-concurrency",
+				EnvVars: []string{"COCOON_BLOB_IMAGE_CONCURRENCY"},
+				Usage:   "How many uploaded images can be checked at the same time when image processing is enabled. Each one is held in memory while it's checked",
+				Value:   server.DefaultBlobImageConcurrency,
+			},
+			&cli.StringSliceFlag{
+				Name:    "lexicon-dir",
+				EnvVars: []string{"COCOON_LEXICON_DIRS"},
+				Usage:   "Additional directories of lexicon JSON files used to validate records. These take precedence over the built in lexicons.",
+			},
 		},
 		Commands: []*cli.Command{
 			runServe,
@@ -161,6 +254,8 @@ func main() {
 			runCreatePrivateJwk,
 			runCreateInviteCode,
 			runResetPassword,
+			runRepo,
+			runBlobs,
 		},
 		ErrWriter: os.Stdout,
 		Version:   Version,
@@ -209,7 +304,27 @@ var runServe = &cli.Command{
 			},
 			SessionSecret:     cmd.String("session-secret"),
 			BlockstoreVariant: server.MustReturnBlockstoreVariant(cmd.String("blockstore-variant")),
+			BlockCacheSize:    cmd.Int64("block-cache-size"),
 			FallbackProxy:     cmd.String("fallback-proxy"),
+
+			RepoCompactInterval:  cmd.Duration("repo-compact-interval"),
+			RepoHistoryRetention: cmd.Duration("repo-history-retention"),
+
+			ImportSpoolDir: cmd.String("import-spool-dir"),
+			ImportMaxSize:  cmd.Int64("import-max-size"),
+
+			EventsBackfillWindow: cmd.Duration("events-backfill-window"),
+			LexiconDirs:          cmd.StringSlice("lexicon-dir"),
+			DiskBlobstorePath:    cmd.String("disk-blobstore-path"),
+			BlobGCGracePeriod:    cmd.Duration("blob-gc-grace-period"),
+			BlobMaxSize:          cmd.Int64("blob-max-size"),
+			BlobMimeLimits:       cmd.StringSlice("blob-mime-limit"),
+			BlobQuota:            cmd.Int64("blob-quota"),
+			BlobImageProcessing:  cmd.Bool("blob-image-processing"),
+			BlobImageMaxPixels:   cmd.Int64("blob-image-max-pixels"),
+			BlobImageConcurrency: cmd.Int("blob-image-concurrency"),
+
+			BlobReconcileInterval: cmd.Duration("blob-reconcile-interval"),
 		})
 		if err != nil {
 			fmt.Printf("error creating cocoon: %v", err)
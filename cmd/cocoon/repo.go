@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/identity"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/repo_indexer"
+	"github.com/haileyok/cocoon/repo_verifier"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+var runRepo = &cli.Command{
+	Name:  "repo",
+	Usage: "repo maintenance commands",
+	Subcommands: []*cli.Command{
+		runRepoBackfillRevs,
+		runRepoCompact,
+		runRepoVerify,
+		runRepoReindex,
+	},
+}
+
+var runRepoBackfillRevs = &cli.Command{
+	Name:  "backfill-revs",
+	Usage: "rederives the rev of every block by walking the commit history. stop the pds before running this",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "optional did of a single repo to backfill. all repos are backfilled if not set",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		dids, err := repoDids(cmd, dbw)
+		if err != nil {
+			return err
+		}
+
+		for _, did := range dids {
+			res, err := sqlite_blockstore.BackfillRevs(cmd.Context, dbw, did)
+			if err != nil {
+				return fmt.Errorf("error backfilling revs for %s: %w", did, err)
+			}
+
+			fmt.Printf("%s: walked %d commits, updated %d blocks, %d orphaned blocks\n", did, res.Commits, res.Updated, res.Orphans)
+		}
+
+		return nil
+	},
+}
+
+var runRepoCompact = &cli.Command{
+	Name:  "compact",
+	Usage: "deletes blocks that are no longer reachable from a repo's root. stop the pds before running this",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "optional did of a single repo to compact. all repos are compacted if not set",
+		},
+		&cli.DurationFlag{
+			Name:  "history-retention",
+			Usage: "keep enough blocks to rebuild the repo as it was at any point within this long ago",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "report what would be deleted without deleting it",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		dids, err := repoDids(cmd, dbw)
+		if err != nil {
+			return err
+		}
+
+		var keepSince string
+		if retention := cmd.Duration("history-retention"); retention > 0 {
+			keepSince = syntax.NewTID(time.Now().Add(-retention).UnixMicro(), 0).String()
+		}
+
+		for _, did := range dids {
+			var row struct {
+				Root []byte
+			}
+			if err := dbw.Raw(cmd.Context, "SELECT root FROM repos WHERE did = ?", nil, did).Scan(&row).Error; err != nil {
+				return err
+			}
+
+			rc, err := cid.Cast(row.Root)
+			if err != nil {
+				return fmt.Errorf("error parsing root of %s: %w", did, err)
+			}
+
+			res, err := sqlite_blockstore.Compact(cmd.Context, dbw, sqlite_blockstore.CompactArgs{
+				Did:       did,
+				Root:      rc,
+				KeepSince: keepSince,
+				DryRun:    cmd.Bool("dry-run"),
+			})
+			if err != nil {
+				return fmt.Errorf("error compacting %s: %w", did, err)
+			}
+
+			if cmd.Bool("dry-run") {
+				fmt.Printf("%s: kept %d commits and %d blocks, would delete %d blocks (%d bytes)\n", did, res.Commits, res.Reachable, res.Deleted, res.Bytes)
+			} else {
+				fmt.Printf("%s: kept %d commits and %d blocks, deleted %d blocks (%d bytes)\n", did, res.Commits, res.Reachable, res.Deleted, res.Bytes)
+			}
+		}
+
+		return nil
+	},
+}
+
+var runRepoVerify = &cli.Command{
+	Name:  "verify",
+	Usage: "checks repos for consistency and prints a json report for each one. results can be off for repos that are written to while they're checked, so prefer the admin endpoint on a running pds",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "optional did of a single repo to verify. all repos are verified if not set",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		dids, err := repoDids(cmd, dbw)
+		if err != nil {
+			return err
+		}
+
+		passport := identity.NewPassport(nil, identity.NewMemCache(100))
+		resolveKey := func(ctx context.Context, did string) (atcrypto.PublicKey, error) {
+			doc, err := passport.FetchDoc(ctx, did)
+			if err != nil {
+				return nil, err
+			}
+			return doc.SigningKey()
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+
+		failed := 0
+		for _, did := range dids {
+			report, err := repo_verifier.Verify(cmd.Context, dbw, did, resolveKey)
+			if err != nil {
+				return fmt.Errorf("error verifying %s: %w", did, err)
+			}
+
+			if !report.Ok {
+				failed++
+			}
+
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d repos have problems", failed, len(dids))
+		}
+
+		return nil
+	},
+}
+
+var runRepoReindex = &cli.Command{
+	Name:  "reindex",
+	Usage: "rebuilds the records table and blob ref counts of repos from their mst. safe to run while the pds is running",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "did",
+			Usage: "did of the repo to reindex",
+		},
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "reindex every repo",
+		},
+	},
+	Action: func(cmd *cli.Context) error {
+		if (cmd.String("did") == "") == !cmd.Bool("all") {
+			return fmt.Errorf("exactly one of --did or --all must be set")
+		}
+
+		gdb, err := newDb(cmd)
+		if err != nil {
+			return err
+		}
+		dbw := db.NewDB(gdb)
+
+		dids, err := repoDids(cmd, dbw)
+		if err != nil {
+			return err
+		}
+
+		for _, did := range dids {
+			res, err := repo_indexer.Reindex(cmd.Context, dbw, did)
+			if err != nil {
+				return fmt.Errorf("error reindexing %s: %w", did, err)
+			}
+
+			fmt.Printf("%s: %d records (%d added, %d updated, %d removed), recounted refs for %d blobs\n", did, res.Records, res.Added, res.Updated, res.Removed, res.Blobs)
+		}
+
+		return nil
+	},
+}
+
+// repoDids returns the did passed with --did, or every repo on the pds if it wasn't set
+func repoDids(cmd *cli.Context, dbw *db.DB) ([]string, error) {
+	if cmd.String("did") != "" {
+		did, err := syntax.ParseDID(cmd.String("did"))
+		if err != nil {
+			return nil, err
+		}
+		return []string{did.String()}, nil
+	}
+
+	var dids []string
+	if err := dbw.Raw(cmd.Context, "SELECT did FROM repos ORDER BY did ASC", nil).Scan(&dids).Error; err != nil {
+		return nil, err
+	}
+
+	return dids, nil
+}
@@ -0,0 +1,236 @@
+package db_persister
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	imodels "github.com/bluesky-social/indigo/models"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+)
+
+const (
+	playbackBatchSize = 500
+)
+
+// DbPersister stores every firehose event in the events table so that subscribers can replay from a cursor after a
+// restart. events older than the backfill window are removed by Prune.
+type DbPersister struct {
+	db             *db.DB
+	sequencer      *Sequencer
+	backfillWindow time.Duration
+
+	// lk is held while broadcasting, so that subscribers see events in seq order
+	lk            sync.Mutex
+	lastBroadcast int64
+
+	broadcast func(*events.XRPCStreamEvent)
+}
+
+func New(db *db.DB, sequencer *Sequencer, backfillWindow time.Duration) *DbPersister {
+	return &DbPersister{
+		db:             db,
+		sequencer:      sequencer,
+		backfillWindow: backfillWindow,
+	}
+}
+
+// Init loads the current sequence number from the database. this needs to be called after the events table has been
+// migrated and before any events are persisted.
+func (p *DbPersister) Init(ctx context.Context) error {
+	if err := p.sequencer.Init(ctx); err != nil {
+		return err
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.lastBroadcast = p.sequencer.Current()
+
+	return nil
+}
+
+// Persist stores an event in a transaction of its own, and then broadcasts it. events that go along with other writes
+// should be stored with PersistTx instead, so that they're only stored if those writes are
+func (p *DbPersister) Persist(ctx context.Context, e *events.XRPCStreamEvent) error {
+	if err := p.db.Transaction(ctx, func(tx *db.DB) error {
+		return p.PersistTx(ctx, tx, e)
+	}); err != nil {
+		return err
+	}
+
+	return p.Broadcast(ctx, e)
+}
+
+// PersistTx stores an event as part of tx, giving it the next seq. subscribers don't see the event until Broadcast is
+// called with it, which must only happen once tx has been committed
+func (p *DbPersister) PersistTx(ctx context.Context, tx *db.DB, e *events.XRPCStreamEvent) error {
+	seq, err := p.sequencer.NextTx(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	var did string
+	switch {
+	case e.RepoCommit != nil:
+		e.RepoCommit.Seq = seq
+		did = e.RepoCommit.Repo
+	case e.RepoSync != nil:
+		e.RepoSync.Seq = seq
+		did = e.RepoSync.Did
+	case e.RepoIdentity != nil:
+		e.RepoIdentity.Seq = seq
+		did = e.RepoIdentity.Did
+	case e.RepoAccount != nil:
+		e.RepoAccount.Seq = seq
+		did = e.RepoAccount.Did
+	default:
+		return fmt.Errorf("unsupported event kind in persist call")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := e.Serialize(buf); err != nil {
+		return fmt.Errorf("error serializing event: %w", err)
+	}
+
+	evt := models.Event{
+		Seq:       seq,
+		Did:       did,
+		CreatedAt: time.Now(),
+		Data:      buf.Bytes(),
+	}
+
+	if err := tx.Create(ctx, &evt, nil).Error; err != nil {
+		return fmt.Errorf("error inserting event: %w", err)
+	}
+
+	e.Preserialized = evt.Data
+
+	return nil
+}
+
+// Broadcast sends a committed event out to subscribers. subscribers always see events in seq order, so if events before
+// this one haven't been broadcast yet, they're read back out of the events table and sent first. seqs are handed out in
+// commit order, so they're already stored. an event that was already sent that way isn't sent again. an error means
+// some of the earlier events couldn't be sent, but they can still be replayed with a cursor
+func (p *DbPersister) Broadcast(ctx context.Context, e *events.XRPCStreamEvent) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	seq := eventSeq(e)
+	if seq <= p.lastBroadcast {
+		return nil
+	}
+
+	var err error
+	if seq > p.lastBroadcast+1 {
+		err = p.Playback(ctx, p.lastBroadcast, func(evt *events.XRPCStreamEvent) error {
+			if s := eventSeq(evt); s < seq {
+				p.broadcast(evt)
+				p.lastBroadcast = s
+			}
+			return nil
+		})
+		if err != nil {
+			err = fmt.Errorf("error sending events before %d: %w", seq, err)
+		}
+	}
+
+	p.broadcast(e)
+	p.lastBroadcast = seq
+	p.sequencer.committed(seq)
+
+	return err
+}
+
+func eventSeq(e *events.XRPCStreamEvent) int64 {
+	switch {
+	case e.RepoCommit != nil:
+		return e.RepoCommit.Seq
+	case e.RepoSync != nil:
+		return e.RepoSync.Seq
+	case e.RepoIdentity != nil:
+		return e.RepoIdentity.Seq
+	case e.RepoAccount != nil:
+		return e.RepoAccount.Seq
+	default:
+		return 0
+	}
+}
+
+func (p *DbPersister) Playback(ctx context.Context, since int64, cb func(*events.XRPCStreamEvent) error) error {
+	for {
+		var evts []models.Event
+		if err := p.db.Raw(ctx, "SELECT * FROM events WHERE seq > ? ORDER BY seq ASC LIMIT ?", nil, since, playbackBatchSize).Scan(&evts).Error; err != nil {
+			return fmt.Errorf("error getting events for playback: %w", err)
+		}
+
+		for _, evt := range evts {
+			var xevt events.XRPCStreamEvent
+			if err := xevt.Deserialize(bytes.NewReader(evt.Data)); err != nil {
+				return fmt.Errorf("error deserializing event %d: %w", evt.Seq, err)
+			}
+			xevt.Preserialized = evt.Data
+
+			if err := cb(&xevt); err != nil {
+				return err
+			}
+
+			since = evt.Seq
+		}
+
+		if len(evts) < playbackBatchSize {
+			return nil
+		}
+	}
+}
+
+// CurrentSeq returns the sequence number of the most recently persisted event
+func (p *DbPersister) CurrentSeq() int64 {
+	return p.sequencer.Current()
+}
+
+// OldestSeq returns the sequence number of the oldest event still inside of the backfill window, or zero if there are
+// no events stored
+func (p *DbPersister) OldestSeq(ctx context.Context) (int64, error) {
+	var res struct {
+		Seq int64
+	}
+	if err := p.db.Raw(ctx, "SELECT COALESCE(MIN(seq), 0) AS seq FROM events", nil).Scan(&res).Error; err != nil {
+		return 0, err
+	}
+	return res.Seq, nil
+}
+
+// Prune deletes all events that have fallen outside of the backfill window, returning the number of removed events
+func (p *DbPersister) Prune(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-p.backfillWindow)
+
+	// always keep the latest event around so that the max seq survives restarts even if the pds has been idle for
+	// longer than the backfill window
+	res := p.db.Exec(ctx, "DELETE FROM events WHERE created_at < ? AND seq < (SELECT MAX(seq) FROM events)", nil, cutoff)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	return res.RowsAffected, nil
+}
+
+func (p *DbPersister) TakeDownRepo(ctx context.Context, usr imodels.Uid) error {
+	return fmt.Errorf("repo takedowns not currently supported by db persister")
+}
+
+func (p *DbPersister) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (p *DbPersister) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (p *DbPersister) SetEventBroadcaster(brc func(*events.XRPCStreamEvent)) {
+	p.broadcast = brc
+}
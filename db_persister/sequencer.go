@@ -0,0 +1,91 @@
+package db_persister
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	"gorm.io/gorm/clause"
+)
+
+// Sequencer hands out the seq numbers for every firehose event, regardless of the event kind. the last handed out seq
+// is stored in the event_sequences table so that it survives restarts even if every event has been pruned.
+type Sequencer struct {
+	db *db.DB
+
+	lk  sync.Mutex
+	seq int64
+}
+
+func NewSequencer(db *db.DB) *Sequencer {
+	return &Sequencer{
+		db: db,
+	}
+}
+
+// Init loads the last seq from the database. databases that were written to before event_sequences existed only have
+// the events table to go off of, so we take whichever is larger
+func (sq *Sequencer) Init(ctx context.Context) error {
+	sq.lk.Lock()
+	defer sq.lk.Unlock()
+
+	var stored struct {
+		Seq int64
+	}
+	if err := sq.db.Raw(ctx, "SELECT COALESCE(MAX(seq), 0) AS seq FROM event_sequences", nil).Scan(&stored).Error; err != nil {
+		return fmt.Errorf("error getting stored event seq: %w", err)
+	}
+
+	var latest struct {
+		Seq int64
+	}
+	if err := sq.db.Raw(ctx, "SELECT COALESCE(MAX(seq), 0) AS seq FROM events", nil).Scan(&latest).Error; err != nil {
+		return fmt.Errorf("error getting latest event seq: %w", err)
+	}
+
+	sq.seq = max(stored.Seq, latest.Seq)
+
+	// NextTx only ever updates this row, so it has to exist before anything gets sequenced
+	if err := sq.db.Create(ctx, &models.EventSequence{ID: 1, Seq: sq.seq}, []clause.Expression{clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"seq"}),
+	}}).Error; err != nil {
+		return fmt.Errorf("error storing event seq: %w", err)
+	}
+
+	return nil
+}
+
+// NextTx advances the sequence as part of tx and returns the new seq. the seq is only used up if tx commits, so failed
+// events don't leave gaps. the event_sequences row stays locked until tx is done, which makes concurrent transactions
+// take their seqs one after another, in the same order that they commit in
+func (sq *Sequencer) NextTx(ctx context.Context, tx *db.DB) (int64, error) {
+	if err := tx.Exec(ctx, "UPDATE event_sequences SET seq = seq + 1 WHERE id = 1", nil).Error; err != nil {
+		return 0, fmt.Errorf("error advancing event seq: %w", err)
+	}
+
+	var res struct {
+		Seq int64
+	}
+	if err := tx.Raw(ctx, "SELECT seq FROM event_sequences WHERE id = 1", nil).Scan(&res).Error; err != nil {
+		return 0, fmt.Errorf("error getting event seq: %w", err)
+	}
+
+	return res.Seq, nil
+}
+
+// committed records that the event with the given seq has been committed
+func (sq *Sequencer) committed(seq int64) {
+	sq.lk.Lock()
+	defer sq.lk.Unlock()
+	sq.seq = max(sq.seq, seq)
+}
+
+// Current returns the seq of the most recently committed event
+func (sq *Sequencer) Current() int64 {
+	sq.lk.Lock()
+	defer sq.lk.Unlock()
+	return sq.seq
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	atproto_identity "github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/util"
 )
@@ -133,6 +135,32 @@ func FetchDidDoc(ctx context.Context, cli *http.Client, did string) (*DidDoc, er
 	return &diddoc, nil
 }
 
+// SigningKey returns the atproto signing key from a did doc, which is the key that repo commits are signed with
+func (d *DidDoc) SigningKey() (atcrypto.PublicKey, error) {
+	did, err := syntax.ParseDID(d.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]atproto_identity.DocVerificationMethod, len(d.VerificationMethods))
+	for i, vm := range d.VerificationMethods {
+		vms[i] = atproto_identity.DocVerificationMethod{
+			ID:                 vm.Id,
+			Type:               vm.Type,
+			Controller:         vm.Controller,
+			PublicKeyMultibase: vm.PublicKeyMultibase,
+		}
+	}
+
+	ident := atproto_identity.ParseIdentity(&atproto_identity.DIDDocument{
+		DID:                did,
+		AlsoKnownAs:        d.AlsoKnownAs,
+		VerificationMethod: vms,
+	})
+
+	return ident.PublicKey()
+}
+
 func FetchDidData(ctx context.Context, cli *http.Client, did string) (*DidData, error) {
 	if cli == nil {
 		cli = util.RobustHTTPClient()
@@ -0,0 +1,115 @@
+package image_sanitizer
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	gifExtension      = 0x21
+	gifImage          = 0x2c
+	gifTrailer        = 0x3b
+	gifCommentLabel   = 0xfe
+	gifAppLabel       = 0xff
+	gifColorTableFlag = 0x80
+)
+
+// stripGif drops comments and application extensions, which is where xmp lives. the netscape extension is kept since
+// that's what makes an animation loop
+func stripGif(data []byte) ([]byte, error) {
+	if len(data) < 13 || (!bytes.HasPrefix(data, []byte("GIF87a")) && !bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return nil, errors.New("missing gif header")
+	}
+
+	// header, logical screen descriptor and the global color table if there is one
+	i := 13
+	if data[10]&gifColorTableFlag != 0 {
+		i += 3 << (int(data[10]&0x07) + 1)
+	}
+	if i > len(data) {
+		return nil, errors.New("gif ended in its color table")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+
+	for i < len(data) {
+		start := i
+
+		switch data[i] {
+		case gifTrailer:
+			// anything after the trailer isn't part of the image
+			out = append(out, gifTrailer)
+			return out, nil
+		case gifExtension:
+			if i+2 > len(data) {
+				return nil, errors.New("gif ended in an extension")
+			}
+			label := data[i+1]
+
+			end, err := gifSkipSubBlocks(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+
+			keep := true
+			switch label {
+			case gifCommentLabel:
+				keep = false
+			case gifAppLabel:
+				// the first sub block holds the application identifier
+				keep = i-start > 14 && (bytes.Equal(data[start+3:start+14], []byte("NETSCAPE2.0")) || bytes.Equal(data[start+3:start+14], []byte("ANIMEXTS1.0")))
+			}
+
+			if keep {
+				out = append(out, data[start:i]...)
+			}
+		case gifImage:
+			// image descriptor, then the local color table if there is one, then the lzw code size
+			if i+10 > len(data) {
+				return nil, errors.New("gif ended in an image descriptor")
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&gifColorTableFlag != 0 {
+				i += 3 << (int(flags&0x07) + 1)
+			}
+			i++
+			if i > len(data) {
+				return nil, errors.New("gif ended in an image")
+			}
+
+			end, err := gifSkipSubBlocks(data, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+
+			out = append(out, data[start:i]...)
+		default:
+			return nil, errors.New("invalid gif block")
+		}
+	}
+
+	// some encoders leave off the trailer, so add it back
+	out = append(out, gifTrailer)
+	return out, nil
+}
+
+// gifSkipSubBlocks returns the position right after a run of sub blocks, which ends with an empty block
+func gifSkipSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, errors.New("gif ended in a data block")
+		}
+
+		n := int(data[i])
+		i++
+		if n == 0 {
+			return i, nil
+		}
+
+		i += n
+	}
+}
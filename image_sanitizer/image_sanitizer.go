@@ -0,0 +1,98 @@
+package image_sanitizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// DefaultMaxPixels allows for a 4000x4000 image, which takes 64MB to decode
+	DefaultMaxPixels = 16_000_000
+)
+
+var (
+	// ErrUnsupported is returned for any mime type that we don't know how to sanitize
+	ErrUnsupported = errors.New("unsupported image type")
+	// ErrInvalidImage is returned whenever an image is corrupt, or too big to safely decode
+	ErrInvalidImage = errors.New("invalid image")
+)
+
+type Options struct {
+	// MaxPixels is the largest width * height that we'll decode. a tiny compressed image can claim to be enormous, and
+	// decoding it would allocate all of that memory
+	MaxPixels int64
+}
+
+// Supported reports whether images of the mime type can be sanitized
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// Sanitize strips metadata like exif, xmp and text comments out of an image, and makes sure what's left is a valid
+// image. metadata is removed at the container level, so the image data itself is stored untouched rather than being
+// re-encoded. the orientation of a jpeg is kept though, since it would show up sideways without it
+func Sanitize(mimeType string, data []byte, opts Options) ([]byte, error) {
+	if opts.MaxPixels == 0 {
+		opts.MaxPixels = DefaultMaxPixels
+	}
+
+	var out []byte
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		out, err = stripJpeg(data)
+	case "image/png":
+		out, err = stripPng(data)
+	case "image/gif":
+		out, err = stripGif(data)
+	case "image/webp":
+		out, err = stripWebp(data)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+
+	// only the header is read to begin with, so we can bail on an enormous image before allocating anything for it
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+
+	if err := checkDimensions(cfg.Width, cfg.Height, opts.MaxPixels); err != nil {
+		return nil, err
+	}
+
+	// decode what we're actually going to store, which catches corrupt image data as well as anything we broke while
+	// stripping it
+	if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+
+	return out, nil
+}
+
+func checkDimensions(w, h int, maxPixels int64) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("%w: image has no pixels", ErrInvalidImage)
+	}
+
+	if int64(w)*int64(h) > maxPixels {
+		return fmt.Errorf("%w: image is %dx%d, which is more than %d pixels", ErrInvalidImage, w, h, maxPixels)
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package image_sanitizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// secret is written into every kind of metadata, so it's easy to check that none of it made it through
+const secret = "secret-location"
+
+// testImage is a small image with enough going on that corrupting it can't go unnoticed
+func testImage() *image.Paletted {
+	palette := color.Palette{color.Black, color.White, color.RGBA{R: 0xff, A: 0xff}, color.RGBA{B: 0xff, A: 0xff}}
+
+	img := image.NewPaletted(image.Rect(0, 0, 40, 30), palette)
+	for y := range 30 {
+		for x := range 40 {
+			img.SetColorIndex(x, y, uint8((x/5+y/5)%len(palette)))
+		}
+	}
+
+	return img
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+len(payload)))
+	return append(seg, payload...)
+}
+
+func pngChunk(typ string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func webpChunk(fourcc string, payload []byte) []byte {
+	chunk := append([]byte(fourcc), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+// webpExtendedHeader builds a vp8x chunk with the given flags and canvas size
+func webpExtendedHeader(flags byte, w, h int) []byte {
+	payload := []byte{flags, 0, 0, 0, byte(w - 1), byte((w - 1) >> 8), byte((w - 1) >> 16), byte(h - 1), byte((h - 1) >> 8), byte((h - 1) >> 16)}
+	return webpChunk("VP8X", payload)
+}
+
+type testFormat struct {
+	mimeType string
+	// clean is an image without any metadata
+	clean []byte
+	// tagged is the same image with metadata that should be stripped
+	tagged []byte
+	// check makes sure that anything which should have been kept from tagged still is
+	check func(t *testing.T, out []byte)
+	// data is where the image data starts in clean
+	data int
+	// corrupt breaks the image data in clean, without breaking the container around it
+	corrupt func(data []byte)
+	w, h    int
+}
+
+// corruptMiddle overwrites some of the image data that starts at the offset
+func corruptMiddle(offset int) func(data []byte) {
+	return func(data []byte) {
+		mid := offset + (len(data)-offset)/2
+		for i := mid; i < mid+16; i++ {
+			data[i] = 0xff
+		}
+	}
+}
+
+func testFormats(t *testing.T) []testFormat {
+	t.Helper()
+
+	img := testImage()
+
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	cleanJpeg := jpg.Bytes()
+
+	// exif with a rotated orientation and a gps tag, then xmp and a comment
+	exif := append([]byte("Exif\x00\x00"), exifOrientationSegment(6)[10:]...)
+	exif = append(exif, secret...)
+	taggedJpeg := append([]byte{}, cleanJpeg[:2]...)
+	taggedJpeg = append(taggedJpeg, jpegSegment(jpegAPP1, exif)...)
+	taggedJpeg = append(taggedJpeg, jpegSegment(jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00"+secret))...)
+	taggedJpeg = append(taggedJpeg, jpegSegment(jpegCOM, []byte(secret))...)
+	taggedJpeg = append(taggedJpeg, cleanJpeg[2:]...)
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatal(err)
+	}
+	cleanPng := pngBuf.Bytes()
+
+	// right after the header chunk
+	ihdrEnd := len(pngSignature) + 12 + 13
+	taggedPng := append([]byte{}, cleanPng[:ihdrEnd]...)
+	taggedPng = append(taggedPng, pngChunk("tEXt", []byte("Comment\x00"+secret))...)
+	taggedPng = append(taggedPng, pngChunk("eXIf", []byte("MM\x00\x2a"+secret))...)
+	taggedPng = append(taggedPng, cleanPng[ihdrEnd:]...)
+
+	var gifBuf bytes.Buffer
+	if err := gif.Encode(&gifBuf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	cleanGif := gifBuf.Bytes()
+
+	// a comment and an xmp application extension before the trailer
+	taggedGif := append([]byte{}, cleanGif[:len(cleanGif)-1]...)
+	taggedGif = append(taggedGif, gifExtension, gifCommentLabel, byte(len(secret)))
+	taggedGif = append(taggedGif, secret...)
+	taggedGif = append(taggedGif, 0)
+	taggedGif = append(taggedGif, gifExtension, gifAppLabel, 11)
+	taggedGif = append(taggedGif, "XMP DataXMP"...)
+	taggedGif = append(taggedGif, byte(len(secret)))
+	taggedGif = append(taggedGif, secret...)
+	taggedGif = append(taggedGif, 0, gifTrailer)
+
+	cleanWebp, err := os.ReadFile("testdata/blue-purple-pink.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taggedWebp := webpFile(
+		webpExtendedHeader(webpExifFlag|webpXmpFlag, 150, 100),
+		cleanWebp[12:],
+		webpChunk("EXIF", []byte("MM\x00\x2a"+secret)),
+		webpChunk("XMP ", []byte(secret)),
+	)
+
+	return []testFormat{
+		{
+			mimeType: "image/jpeg",
+			clean:    cleanJpeg,
+			tagged:   taggedJpeg,
+			check: func(t *testing.T, out []byte) {
+				if !bytes.Contains(out, exifOrientationSegment(6)) {
+					t.Error("expected the jpeg's orientation to be kept")
+				}
+			},
+			// past the quantization and huffman tables
+			data: len(cleanJpeg) / 2,
+			corrupt: func(data []byte) {
+				// a frame without any components
+				sof := bytes.Index(data, []byte{0xff, 0xc0})
+				data[sof+9] = 0
+			},
+			w: 40,
+			h: 30,
+		},
+		{
+			mimeType: "image/png",
+			clean:    cleanPng,
+			tagged:   taggedPng,
+			data:     ihdrEnd,
+			corrupt:  corruptMiddle(ihdrEnd),
+			w:        40,
+			h:        30,
+		},
+		{
+			mimeType: "image/gif",
+			clean:    cleanGif,
+			tagged:   taggedGif,
+			data:     len(cleanGif) / 2,
+			corrupt:  corruptMiddle(len(cleanGif) / 2),
+			w:        40,
+			h:        30,
+		},
+		{
+			mimeType: "image/webp",
+			clean:    cleanWebp,
+			tagged:   taggedWebp,
+			check: func(t *testing.T, out []byte) {
+				if flags := out[20]; flags&(webpExifFlag|webpXmpFlag) != 0 {
+					t.Errorf("expected the webp's metadata flags to be cleared, got %#x", flags)
+				}
+			},
+			// past the frame header
+			data: 40,
+			corrupt: func(data []byte) {
+				// the size of the frame's first partition, which runs past the end of the chunk
+				data[21] = 0xff
+				data[22] = 0xff
+			},
+			w: 150,
+			h: 100,
+		},
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for _, f := range testFormats(t) {
+		t.Run(f.mimeType, func(t *testing.T) {
+			tests := []struct {
+				name      string
+				data      func() []byte
+				maxPixels int64
+				invalid   bool
+			}{
+				{
+					name: "clean image is kept as is",
+					data: func() []byte { return f.clean },
+				},
+				{
+					name: "metadata is stripped",
+					data: func() []byte { return f.tagged },
+				},
+				{
+					name:      "image at the pixel limit",
+					data:      func() []byte { return f.tagged },
+					maxPixels: int64(f.w * f.h),
+				},
+				{
+					name:      "image over the pixel limit",
+					data:      func() []byte { return f.tagged },
+					maxPixels: int64(f.w*f.h) - 1,
+					invalid:   true,
+				},
+				{
+					name:    "truncated header",
+					data:    func() []byte { return f.clean[:f.data/2] },
+					invalid: true,
+				},
+				{
+					name:    "truncated image data",
+					data:    func() []byte { return f.clean[:f.data+(len(f.clean)-f.data)/2] },
+					invalid: true,
+				},
+				{
+					name: "corrupt image data",
+					data: func() []byte {
+						// the container is left alone, so this has to be caught by decoding the image
+						data := bytes.Clone(f.clean)
+						f.corrupt(data)
+						return data
+					},
+					invalid: true,
+				},
+				{
+					name:    "not an image",
+					data:    func() []byte { return []byte("hello world, this isn't an image") },
+					invalid: true,
+				},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					in := tt.data()
+
+					out, err := Sanitize(f.mimeType, in, Options{MaxPixels: tt.maxPixels})
+					if tt.invalid {
+						if !errors.Is(err, ErrInvalidImage) {
+							t.Fatalf("expected an invalid image, got %v", err)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if bytes.Contains(out, []byte(secret)) {
+						t.Error("expected metadata to be stripped")
+					}
+
+					if bytes.Equal(in, f.clean) && !bytes.Equal(out, f.clean) {
+						t.Error("expected an image without metadata to be stored as is")
+					}
+
+					if f.check != nil && bytes.Equal(in, f.tagged) {
+						f.check(t, out)
+					}
+
+					img, _, err := image.Decode(bytes.NewReader(out))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if b := img.Bounds(); b.Dx() != f.w || b.Dy() != f.h {
+						t.Errorf("expected a %dx%d image, got %dx%d", f.w, f.h, b.Dx(), b.Dy())
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSanitizeWebpCanvasTooLarge(t *testing.T) {
+	clean, err := os.ReadFile("testdata/blue-purple-pink.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a tiny image can claim a canvas big enough to take gigabytes to decode
+	data := webpFile(webpExtendedHeader(0, 10_000, 10_000), clean[12:])
+
+	if _, err := Sanitize("image/webp", data, Options{}); !errors.Is(err, ErrInvalidImage) {
+		t.Fatalf("expected an invalid image, got %v", err)
+	}
+}
+
+func TestSanitizeUnsupported(t *testing.T) {
+	if _, err := Sanitize("image/tiff", []byte("II*\x00"), Options{}); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected an unsupported image, got %v", err)
+	}
+}
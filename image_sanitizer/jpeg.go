@@ -0,0 +1,230 @@
+package image_sanitizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	jpegSOI  = 0xd8
+	jpegEOI  = 0xd9
+	jpegRST0 = 0xd0
+	jpegRST7 = 0xd7
+	jpegSOS  = 0xda
+	jpegAPP0 = 0xe0
+	jpegAPP1 = 0xe1
+	jpegAPP2 = 0xe2
+	jpegAPPE = 0xee
+	jpegAPPF = 0xef
+	jpegCOM  = 0xfe
+
+	exifOrientationTag = 0x0112
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// stripJpeg drops every app segment except jfif, icc profiles and adobe's color transform, along with any comments.
+// everything from the first scan onwards is copied over as is
+func stripJpeg(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegSOI {
+		return nil, errors.New("missing jpeg start of image")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xff, jpegSOI)
+
+	orientation := 0
+
+	i := 2
+	for {
+		if i+4 > len(data) {
+			return nil, errors.New("jpeg ended before the image data")
+		}
+
+		if data[i] != 0xff {
+			return nil, errors.New("invalid jpeg marker")
+		}
+
+		marker := data[i+1]
+
+		// markers can be padded with any number of 0xff bytes
+		if marker == 0xff {
+			i++
+			continue
+		}
+
+		if marker == jpegSOS {
+			// the exif segment can come anywhere before the scan, so the orientation only gets written back once we've
+			// seen all of the metadata
+			out = insertAfterJfif(out, orientation)
+
+			end, err := jpegEnd(data, i)
+			if err != nil {
+				return nil, err
+			}
+
+			// phones like to tack more images onto the end of a jpeg, each with its own exif, so anything after the end of
+			// the image is dropped
+			out = append(out, data[i:end]...)
+			return out, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, errors.New("invalid jpeg segment length")
+		}
+		seg := data[i : i+2+length]
+		payload := seg[4:]
+
+		keep := true
+		switch {
+		case marker == jpegAPP0, marker == jpegAPPE:
+			// jfif and adobe, which decoders need to get the colors right
+		case marker == jpegAPP1:
+			if bytes.HasPrefix(payload, exifHeader) {
+				if o := exifOrientation(payload[len(exifHeader):]); o > 0 {
+					orientation = o
+				}
+			}
+			keep = false
+		case marker == jpegAPP2:
+			keep = bytes.HasPrefix(payload, iccHeader)
+		case marker > jpegAPP2 && marker <= jpegAPPF, marker == jpegCOM:
+			keep = false
+		}
+
+		if keep {
+			out = append(out, seg...)
+		}
+
+		i += 2 + length
+	}
+}
+
+// jpegEnd finds the end of the image, starting from its first scan. scans are followed by entropy coded data, where a
+// 0xff byte is always followed by a zero or a restart marker, so the next real marker is easy to spot
+func jpegEnd(data []byte, i int) (int, error) {
+	for i+1 < len(data) {
+		if data[i] != 0xff {
+			i++
+			continue
+		}
+
+		marker := data[i+1]
+		switch {
+		case marker == 0x00, marker == 0xff, marker >= jpegRST0 && marker <= jpegRST7:
+			i++
+		case marker == jpegEOI:
+			return i + 2, nil
+		default:
+			// another segment between scans, like the huffman tables of a progressive jpeg
+			if i+4 > len(data) {
+				return 0, errors.New("invalid jpeg segment")
+			}
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			if length < 2 || i+2+length > len(data) {
+				return 0, errors.New("invalid jpeg segment length")
+			}
+			i += 2 + length
+		}
+	}
+
+	// some encoders leave off the end of image marker. if the data is actually broken, decoding it will catch that
+	return len(data), nil
+}
+
+// insertAfterJfif adds an orientation segment to a jpeg that has been written out up to its first scan. the jfif
+// segment has to come first if there is one, so it goes right after that
+func insertAfterJfif(out []byte, orientation int) []byte {
+	if orientation <= 1 {
+		return out
+	}
+
+	pos := 2
+	if len(out) >= 6 && out[2] == 0xff && out[3] == jpegAPP0 {
+		pos = 4 + int(binary.BigEndian.Uint16(out[4:]))
+	}
+
+	seg := exifOrientationSegment(orientation)
+	res := make([]byte, 0, len(out)+len(seg))
+	res = append(res, out[:pos]...)
+	res = append(res, seg...)
+	res = append(res, out[pos:]...)
+	return res
+}
+
+// exifOrientation reads the orientation tag out of the first ifd of an exif tiff structure. zero is returned if it can't
+// be found
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if bo.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+
+	count := int(bo.Uint16(tiff[ifd:]))
+	for n := range count {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		if bo.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+
+		// orientation is a single short, which is stored inline in the value field
+		if bo.Uint16(tiff[entry+2:]) != 3 {
+			return 0
+		}
+
+		o := int(bo.Uint16(tiff[entry+8:]))
+		if o < 1 || o > 8 {
+			return 0
+		}
+		return o
+	}
+
+	return 0
+}
+
+// exifOrientationSegment builds an app1 segment with an exif structure that holds nothing but the orientation
+func exifOrientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, // big endian tiff header
+		0x00, 0x00, 0x00, 0x08, // first ifd right after the header
+		0x00, 0x01, // a single entry
+		0x01, 0x12, // orientation
+		0x00, 0x03, // short
+		0x00, 0x00, 0x00, 0x01, // one value
+		0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // no next ifd
+	}
+
+	seg := []byte{0xff, jpegAPP1, 0x00, 0x00}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+len(exifHeader)+len(tiff)))
+	seg = append(seg, exifHeader...)
+	seg = append(seg, tiff...)
+	return seg
+}
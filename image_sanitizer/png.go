@@ -0,0 +1,55 @@
+package image_sanitizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the ancillary chunks that only carry metadata, and can be dropped without changing the image
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// stripPng drops the text, exif and timestamp chunks. chunks are copied over whole, so their crcs stay valid
+func stripPng(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("missing png signature")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	i := len(pngSignature)
+	for {
+		// length, type and crc
+		if i+12 > len(data) {
+			return nil, errors.New("png ended before its end chunk")
+		}
+
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			return nil, errors.New("invalid png chunk length")
+		}
+
+		typ := string(data[i+4 : i+8])
+		chunk := data[i : i+12+length]
+
+		if !pngMetadataChunks[typ] {
+			out = append(out, chunk...)
+		}
+
+		i += len(chunk)
+
+		// anything after the end chunk isn't part of the image
+		if typ == "IEND" {
+			return out, nil
+		}
+	}
+}
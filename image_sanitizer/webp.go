@@ -0,0 +1,63 @@
+package image_sanitizer
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	webpExifFlag = 0x08
+	webpXmpFlag  = 0x04
+)
+
+// stripWebp drops the exif and xmp chunks from a webp, and clears the flags that say they're there
+func stripWebp(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("missing webp header")
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	if size < 4 || 8+size > len(data) {
+		return nil, errors.New("invalid webp size")
+	}
+	// anything after the riff container isn't part of the image
+	data = data[:8+size]
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+
+	i := 12
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, errors.New("webp ended in a chunk header")
+		}
+
+		fourcc := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+
+		// chunks are padded to an even length
+		end := i + 8 + length + length%2
+		if length < 0 || end > len(data) {
+			return nil, errors.New("invalid webp chunk length")
+		}
+
+		switch fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if length < 10 {
+				return nil, errors.New("invalid webp extended header")
+			}
+			start := len(out)
+			out = append(out, data[i:end]...)
+			out[start+8] &^= webpExifFlag | webpXmpFlag
+		default:
+			out = append(out, data[i:end]...)
+		}
+
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+
+	return out, nil
+}
@@ -56,11 +56,17 @@ func (db *DB) First(ctx context.Context, dest any, conds ...any) *gorm.DB {
 	return db.cli.WithContext(ctx).First(dest, conds...)
 }
 
-// TODO: this isn't actually good. we can commit even if the db is locked here. this is probably okay for the time being, but need to figure
-// out a better solution. right now we only do this whenever we're importing a repo though so i'm mostly not worried, but it's still bad.
-// e.g. when we do apply writes we should also be using a transcation but we don't right now
-func (db *DB) BeginDangerously(ctx context.Context) *gorm.DB {
-	return db.cli.WithContext(ctx).Begin()
+// Transaction runs fn inside of a transaction while holding the write lock. fn must only use the tx that it is given.
+// the write lock isn't reentrant, so calling Create, Save, Exec, Delete or Transaction on db (e.g. s.db) from inside fn
+// deadlocks, and anything else called on db runs outside of the transaction. helpers that get called from inside fn
+// need to take the tx as an argument
+func (db *DB) Transaction(ctx context.Context, fn func(tx *DB) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(NewDB(tx))
+	})
 }
 
 func (db *DB) Lock() {
@@ -0,0 +1,93 @@
+package repowalk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// Walk visits the commit block at root and then every mst node and record that is reachable from it, always visiting
+// a node before anything below it. if skip returns true for a cid, neither that block nor anything below it is
+// visited, which lets callers avoid walking subtrees they've already seen. skip may be nil
+func Walk(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, skip func(cid.Cid) bool, cb func(blocks.Block) error) error {
+	if skip != nil && skip(root) {
+		return nil
+	}
+
+	blk, err := bs.Get(ctx, root)
+	if err != nil {
+		return fmt.Errorf("error getting commit block %s: %w", root, err)
+	}
+
+	var sc repo.SignedCommit
+	if err := sc.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+		return fmt.Errorf("error decoding commit block %s: %w", root, err)
+	}
+
+	if err := cb(blk); err != nil {
+		return err
+	}
+
+	// nodes holds the mst nodes we still need to visit. records are visited as soon as we see them, since there's
+	// nothing below them
+	nodes := []cid.Cid{sc.Data}
+	for len(nodes) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+
+		if skip != nil && skip(c) {
+			continue
+		}
+
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("error getting mst node %s: %w", c, err)
+		}
+
+		var nd mst.NodeData
+		if err := nd.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+			return fmt.Errorf("error decoding mst node %s: %w", c, err)
+		}
+
+		if err := cb(blk); err != nil {
+			return err
+		}
+
+		// push subtrees in reverse so that they get popped off in key order
+		for i := len(nd.Entries) - 1; i >= 0; i-- {
+			if nd.Entries[i].Tree != nil {
+				nodes = append(nodes, *nd.Entries[i].Tree)
+			}
+		}
+		if nd.Left != nil {
+			nodes = append(nodes, *nd.Left)
+		}
+
+		for _, e := range nd.Entries {
+			if skip != nil && skip(e.Val) {
+				continue
+			}
+
+			rec, err := bs.Get(ctx, e.Val)
+			if err != nil {
+				return fmt.Errorf("error getting record %s: %w", e.Val, err)
+			}
+
+			if err := cb(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
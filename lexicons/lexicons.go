@@ -0,0 +1,80 @@
+package lexicons
+
+import (
+	"embed"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/lexicon"
+
+	// maxGraphemes is checked by the lexicon package with uniseg, so the version that we build with decides how many
+	// graphemes a post has. keep it pinned here instead of leaving it up to whatever indigo happens to pull in
+	_ "github.com/rivo/uniseg"
+)
+
+// the embedded schemas are the lexicons for the collections that we see the most of, plus whatever their records
+// reference. anything else can be supplied by the operator through extra lexicon directories
+//
+// the files are copied unmodified from the lexicons directory of github.com/bluesky-social/indigo at commit
+// af2fec94f34c, which mirrors github.com/bluesky-social/atproto. that's newer than the indigo in go.mod, which is older
+// than the lexicons directory and doesn't have one. they can be checked against
+// `go mod download github.com/bluesky-social/indigo@v0.0.0-20260605210604-af2fec94f34c`. to update them, copy the same
+// files over from a newer commit
+//
+//go:embed schemas
+var embeddedSchemas embed.FS
+
+// Registry is a lexicon catalog made up of the schemas that ship with cocoon and any schemas loaded from configured
+// directories. configured schemas take precedence over the embedded ones, so that operators can update a lexicon
+// without waiting on a new release
+type Registry struct {
+	custom   lexicon.BaseCatalog
+	embedded lexicon.BaseCatalog
+}
+
+func NewRegistry(dirs []string) (*Registry, error) {
+	r := &Registry{
+		custom:   lexicon.NewBaseCatalog(),
+		embedded: lexicon.NewBaseCatalog(),
+	}
+
+	if err := r.embedded.LoadEmbedFS(embeddedSchemas); err != nil {
+		return nil, fmt.Errorf("error loading embedded lexicons: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if err := r.custom.LoadDirectory(dir); err != nil {
+			return nil, fmt.Errorf("error loading lexicons from %s: %w", dir, err)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Registry) Resolve(ref string) (*lexicon.Schema, error) {
+	if s, err := r.custom.Resolve(ref); err == nil {
+		return s, nil
+	}
+	return r.embedded.Resolve(ref)
+}
+
+// HasRecord reports whether the registry knows of a record schema for the given nsid
+func (r *Registry) HasRecord(nsid string) bool {
+	s, err := r.Resolve(nsid)
+	if err != nil {
+		return false
+	}
+	_, ok := s.Def.(lexicon.SchemaRecord)
+	return ok
+}
+
+// ValidateRecord validates a record against the schema for nsid. the record is expected to be in the form returned by
+// atdata.UnmarshalJSON, i.e. with blobs, bytes and links already converted
+func (r *Registry) ValidateRecord(nsid string, rec map[string]any) error {
+	if t, _ := rec["$type"].(string); t != nsid {
+		return fmt.Errorf("invalid $type: expected %s, got %q", nsid, t)
+	}
+
+	// lenient mode still lets through legacy blobs and datetimes that are slightly off, which older clients have been
+	// writing forever
+	return lexicon.ValidateRecord(r, rec, nsid, lexicon.LenientMode)
+}
@@ -29,6 +29,10 @@ type Repo struct {
 	Root                           []byte
 	Preferences                    []byte
 	Deactivated                    bool
+	BlobQuota                      *int64
+	// BlobRefsCounted is set once the repo's blob ref counts have been rederived from its records. repos written before
+	// refs were counted start out with everything at zero
+	BlobRefsCounted bool
 }
 
 func (r *Repo) SignFor(ctx context.Context, did string, msg []byte) ([]byte, error) {
@@ -111,6 +115,8 @@ type Blob struct {
 	Cid       []byte `gorm:"index;index:idx_blob_did_cid"`
 	RefCount  int
 	Storage   string `gorm:"default:sqlite"`
+	MimeType  string
+	Size      int64
 }
 
 type BlobPart struct {
@@ -126,3 +132,33 @@ type ReservedKey struct {
 	PrivateKey []byte
 	CreatedAt  time.Time `gorm:"index"`
 }
+
+type Event struct {
+	Seq       int64     `gorm:"primaryKey;autoIncrement:false"`
+	Did       string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+	Data      []byte
+}
+
+type EventSequence struct {
+	ID  uint `gorm:"primaryKey"`
+	Seq int64
+}
+
+type ImportJob struct {
+	ID        string `gorm:"primaryKey"`
+	Did       string `gorm:"index"`
+	State     string `gorm:"index"`
+	Blocks    int64
+	Records   int64
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ImportBlock holds the blocks of a repo import while it's being checked, before they're moved into blocks
+type ImportBlock struct {
+	ImportID string `gorm:"primaryKey"`
+	Cid      []byte `gorm:"primaryKey"`
+	Value    []byte
+}
@@ -0,0 +1,251 @@
+package repo_indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atdata"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+const (
+	insertBatchSize  = 500
+	reindexAttempts  = 5
+	existingPageSize = 1000
+)
+
+var (
+	// ErrRepoNotFound is returned when there's no repo for the did being reindexed
+	ErrRepoNotFound = errors.New("repo not found")
+	// ErrRepoChanged is returned when the repo was written to every time we tried to swap in the new index
+	ErrRepoChanged = errors.New("repo kept changing while it was being reindexed")
+)
+
+// errRootChanged means the repo was written to after we walked it, so the rows we built are already stale
+var errRootChanged = errors.New("repo root changed")
+
+type ReindexResult struct {
+	Records int
+	Added   int
+	Removed int
+	Updated int
+	Blobs   int
+}
+
+// Reindex regenerates the records table rows for a repo from its mst, and then recounts the refs of its blobs. the mst
+// is walked without holding any locks, and the rows are swapped in with a single transaction that first makes sure the
+// repo's root hasn't moved in the meantime. if it has, we start over. this means a reindex can run against a live pds
+// without holding up writes, and a write to one repo never waits on the reindex of another
+func Reindex(ctx context.Context, dbw *db.DB, did string) (*ReindexResult, error) {
+	for range reindexAttempts {
+		res, err := reindexOnce(ctx, dbw, did)
+		if errors.Is(err, errRootChanged) {
+			continue
+		}
+		return res, err
+	}
+
+	return nil, ErrRepoChanged
+}
+
+func reindexOnce(ctx context.Context, dbw *db.DB, did string) (*ReindexResult, error) {
+	var urepo models.Repo
+	res := dbw.Raw(ctx, "SELECT did, root FROM repos WHERE did = ?", nil, did).Scan(&urepo)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrRepoNotFound
+	}
+
+	rc, err := cid.Cast(urepo.Root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repo root: %w", err)
+	}
+
+	existing, err := existingRecords(ctx, dbw, did)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAts := make(map[string]string, len(existing))
+	for path, rec := range existing {
+		createdAts[path] = rec.CreatedAt
+	}
+
+	records, err := RecordRows(ctx, sqlite_blockstore.NewReadOnly(did, dbw), did, rc, createdAts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReindexResult{
+		Records: len(records),
+	}
+
+	for _, rec := range records {
+		old, ok := existing[rec.Nsid+"/"+rec.Rkey]
+		switch {
+		case !ok:
+			result.Added++
+		case old.Cid != rec.Cid:
+			result.Updated++
+		}
+	}
+	result.Removed = len(existing) - (len(records) - result.Added)
+
+	if err := dbw.Transaction(ctx, func(tx *db.DB) error {
+		// this doesn't change anything, but it does make sure that the root is still the one we walked, and it makes
+		// any write to the repo wait until we're done
+		res := tx.Exec(ctx, "UPDATE repos SET root = root WHERE did = ? AND root = ?", nil, did, rc.Bytes())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errRootChanged
+		}
+
+		if err := tx.Exec(ctx, "DELETE FROM records WHERE did = ?", nil, did).Error; err != nil {
+			return err
+		}
+
+		for i := 0; i < len(records); i += insertBatchSize {
+			batch := records[i:min(i+insertBatchSize, len(records))]
+			if err := tx.Create(ctx, &batch, nil).Error; err != nil {
+				return err
+			}
+		}
+
+		n, err := blobstore.RecountRefs(ctx, tx, did)
+		if err != nil {
+			return err
+		}
+		result.Blobs = n
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// existingRecords returns the records table rows for a repo keyed by their path, without their values
+func existingRecords(ctx context.Context, dbw *db.DB, did string) (map[string]models.Record, error) {
+	existing := map[string]models.Record{}
+
+	var lastNsid, lastRkey string
+	for {
+		var records []models.Record
+		if err := dbw.Raw(ctx, "SELECT nsid, rkey, cid, created_at FROM records WHERE did = ? AND (nsid > ? OR (nsid = ? AND rkey > ?)) ORDER BY nsid ASC, rkey ASC LIMIT ?", nil, did, lastNsid, lastNsid, lastRkey, existingPageSize).Scan(&records).Error; err != nil {
+			return nil, fmt.Errorf("error getting records: %w", err)
+		}
+
+		for _, rec := range records {
+			lastNsid, lastRkey = rec.Nsid, rec.Rkey
+			existing[rec.Nsid+"/"+rec.Rkey] = rec
+		}
+
+		if len(records) < existingPageSize {
+			break
+		}
+	}
+
+	return existing, nil
+}
+
+// RecordRows builds the records table rows for every record in the mst of a repo. see ForEachRecordRow for how each
+// row's created_at is picked
+func RecordRows(ctx context.Context, bs blockstore.Blockstore, did string, root cid.Cid, createdAts map[string]string) ([]models.Record, error) {
+	var records []models.Record
+	if err := ForEachRecordRow(ctx, bs, did, root, createdAts, func(rec models.Record) error {
+		records = append(records, rec)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// ForEachRecordRow builds the records table row for each record in the mst of a repo and passes it to cb, without
+// holding on to any of them. listRecords pages through records by created_at, so it needs to keep them in the order
+// they were created in. records that already have a created_at can be passed in by path to keep it. otherwise, it comes
+// from the rkey if it's a tid, then from the record's own createdAt field, and if neither of those work out the record
+// is treated as if it was created just now
+func ForEachRecordRow(ctx context.Context, bs blockstore.Blockstore, did string, root cid.Cid, createdAts map[string]string, cb func(models.Record) error) error {
+	r, err := repo.OpenRepo(ctx, bs, root)
+	if err != nil {
+		return fmt.Errorf("error opening repo: %w", err)
+	}
+
+	clock := syntax.NewTIDClock(0)
+	// records that get their created_at from a timestamp can end up with the same one, so each gets a different clock id
+	var clockID uint
+
+	if err := r.ForEach(ctx, "", func(key string, c cid.Cid) error {
+		nsid, rkey, ok := strings.Cut(key, "/")
+		if !ok {
+			return fmt.Errorf("invalid record path %q", key)
+		}
+
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("error getting record %s: %w", key, err)
+		}
+
+		createdAt, ok := createdAts[key]
+		if !ok {
+			if tid, err := syntax.ParseTID(rkey); err == nil {
+				createdAt = tid.String()
+			} else if t, ok := recordCreatedAt(blk.RawData()); ok {
+				createdAt = syntax.NewTIDFromTime(t, clockID%1024).String()
+				clockID++
+			} else {
+				createdAt = clock.Next().String()
+			}
+		}
+
+		return cb(models.Record{
+			Did:       did,
+			CreatedAt: createdAt,
+			Nsid:      nsid,
+			Rkey:      rkey,
+			Cid:       c.String(),
+			Value:     blk.RawData(),
+		})
+	}); err != nil {
+		return fmt.Errorf("error reading records: %w", err)
+	}
+
+	return nil
+}
+
+// recordCreatedAt returns the createdAt field of a cbor encoded record, if it has a valid one
+func recordCreatedAt(value []byte) (time.Time, bool) {
+	decoded, err := atdata.UnmarshalCBOR(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	raw, ok := decoded["createdAt"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	dt, err := syntax.ParseDatetimeLenient(raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return dt.Time(), true
+}
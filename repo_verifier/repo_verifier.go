@@ -0,0 +1,333 @@
+package repo_verifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/internal/repowalk"
+	"github.com/haileyok/cocoon/models"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	recordsBatchSize = 500
+)
+
+// ErrRepoNotFound is returned when there's no repo for the did being verified
+var ErrRepoNotFound = errors.New("repo not found")
+
+const (
+	// ProblemCommit means the commit block is missing, can't be decoded, or doesn't match the repo
+	ProblemCommit = "commit"
+	// ProblemSignature means the commit isn't signed by the did's current signing key, or the key couldn't be resolved
+	ProblemSignature = "signature"
+	// ProblemBlockHash means a block's bytes don't hash to its cid
+	ProblemBlockHash = "block_hash"
+	// ProblemMst means the mst couldn't be walked, usually because a block is missing
+	ProblemMst = "mst"
+	// ProblemRecordMissing means a record is in the mst but not the records table
+	ProblemRecordMissing = "record_missing"
+	// ProblemRecordExtra means a record is in the records table but not the mst
+	ProblemRecordExtra = "record_extra"
+	// ProblemRecordMismatch means a row in the records table doesn't match the record in the mst
+	ProblemRecordMismatch = "record_mismatch"
+	// ProblemRecordInvalid means a record in the mst couldn't be decoded
+	ProblemRecordInvalid = "record_invalid"
+	// ProblemBlobRefCount means a blob's ref_count doesn't match the number of records that reference it
+	ProblemBlobRefCount = "blob_ref_count"
+	// ProblemBlobMissing means a record references a blob that was never uploaded
+	ProblemBlobMissing = "blob_missing"
+)
+
+type Problem struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	Cid     string `json:"cid,omitempty"`
+	Message string `json:"message"`
+}
+
+type Report struct {
+	Did            string    `json:"did"`
+	Root           string    `json:"root,omitempty"`
+	Rev            string    `json:"rev,omitempty"`
+	Ok             bool      `json:"ok"`
+	SignatureValid bool      `json:"signatureValid"`
+	Blocks         int       `json:"blocks"`
+	Records        int       `json:"records"`
+	Blobs          int       `json:"blobs"`
+	Problems       []Problem `json:"problems"`
+}
+
+func (r *Report) addProblem(kind, path string, c *cid.Cid, format string, args ...any) {
+	p := Problem{
+		Kind:    kind,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if c != nil {
+		p.Cid = c.String()
+	}
+	r.Problems = append(r.Problems, p)
+}
+
+// KeyResolver returns the current signing key of a did
+type KeyResolver func(ctx context.Context, did string) (atcrypto.PublicKey, error)
+
+// Verify checks a repo for consistency. the commit at repos.root has to be signed by the did's signing key, every block
+// reachable from it has to hash to its cid, the records table has to match the leaves of the mst, and every blob's
+// ref_count has to match the records that reference it. anything that doesn't check out is added to the report as a
+// problem. an error is only returned when the check itself couldn't be run. nothing should be writing to the repo
+// while it's being verified, otherwise the records table and the mst can look like they disagree when they don't
+func Verify(ctx context.Context, dbw *db.DB, did string, resolveKey KeyResolver) (*Report, error) {
+	var urepo models.Repo
+	res := dbw.Raw(ctx, "SELECT did, root, rev FROM repos WHERE did = ?", nil, did).Scan(&urepo)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrRepoNotFound
+	}
+
+	report := &Report{
+		Did:      did,
+		Rev:      urepo.Rev,
+		Problems: []Problem{},
+	}
+
+	rc, err := cid.Cast(urepo.Root)
+	if err != nil {
+		report.addProblem(ProblemCommit, "", nil, "invalid repo root: %s", err)
+		return report.finish(), nil
+	}
+	report.Root = rc.String()
+
+	bs := sqlite_blockstore.NewReadOnly(did, dbw)
+
+	if !verifyCommit(ctx, bs, report, rc, resolveKey) {
+		return report.finish(), nil
+	}
+
+	// walk everything that's reachable from the commit, making sure each block is what its cid says it is
+	seen := map[cid.Cid]struct{}{}
+	if err := repowalk.Walk(ctx, bs, rc, func(c cid.Cid) bool {
+		_, ok := seen[c]
+		return ok
+	}, func(blk blocks.Block) error {
+		seen[blk.Cid()] = struct{}{}
+		report.Blocks++
+
+		c := blk.Cid()
+		sum, err := c.Prefix().Sum(blk.RawData())
+		if err != nil || !sum.Equals(c) {
+			report.addProblem(ProblemBlockHash, "", &c, "block bytes don't match its cid")
+		}
+
+		return nil
+	}); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		report.addProblem(ProblemMst, "", nil, "error walking repo: %s", err)
+		return report.finish(), nil
+	}
+
+	r, err := repo.OpenRepo(ctx, bs, rc)
+	if err != nil {
+		report.addProblem(ProblemMst, "", nil, "error opening repo: %s", err)
+		return report.finish(), nil
+	}
+
+	leaves := map[string]cid.Cid{}
+	if err := r.ForEach(ctx, "", func(k string, v cid.Cid) error {
+		leaves[k] = v
+		return nil
+	}); err != nil {
+		report.addProblem(ProblemMst, "", nil, "error reading mst leaves: %s", err)
+		return report.finish(), nil
+	}
+	report.Records = len(leaves)
+
+	paths := make([]string, 0, len(leaves))
+	for k := range leaves {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+
+	if err := verifyRecords(ctx, dbw, report, did, leaves, paths); err != nil {
+		return nil, err
+	}
+
+	if err := verifyBlobRefs(ctx, dbw, bs, report, did, leaves, paths); err != nil {
+		return nil, err
+	}
+
+	return report.finish(), nil
+}
+
+func (r *Report) finish() *Report {
+	r.Ok = len(r.Problems) == 0
+	return r
+}
+
+// verifyCommit checks the commit block and its signature, and reports whether the rest of the repo can be checked
+func verifyCommit(ctx context.Context, bs *sqlite_blockstore.SqliteBlockstore, report *Report, rc cid.Cid, resolveKey KeyResolver) bool {
+	blk, err := bs.Get(ctx, rc)
+	if err != nil {
+		report.addProblem(ProblemCommit, "", &rc, "error getting commit block: %s", err)
+		return false
+	}
+
+	var sc repo.SignedCommit
+	if err := sc.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+		report.addProblem(ProblemCommit, "", &rc, "error decoding commit: %s", err)
+		return false
+	}
+
+	if sc.Did != report.Did {
+		report.addProblem(ProblemCommit, "", &rc, "commit is for %s", sc.Did)
+	}
+
+	if sc.Rev != report.Rev {
+		report.addProblem(ProblemCommit, "", &rc, "commit rev %s doesn't match repo rev %s", sc.Rev, report.Rev)
+	}
+
+	key, err := resolveKey(ctx, report.Did)
+	if err != nil {
+		report.addProblem(ProblemSignature, "", &rc, "error resolving signing key: %s", err)
+		return true
+	}
+
+	unsigned, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		report.addProblem(ProblemSignature, "", &rc, "error encoding unsigned commit: %s", err)
+		return true
+	}
+
+	if err := key.HashAndVerifyLenient(unsigned, sc.Sig); err != nil {
+		report.addProblem(ProblemSignature, "", &rc, "commit signature doesn't match the did's signing key: %s", err)
+		return true
+	}
+
+	report.SignatureValid = true
+	return true
+}
+
+// verifyRecords diffs the records table against the leaves of the mst
+func verifyRecords(ctx context.Context, dbw *db.DB, report *Report, did string, leaves map[string]cid.Cid, paths []string) error {
+	found := map[string]struct{}{}
+
+	var lastNsid, lastRkey string
+	for {
+		var records []models.Record
+		if err := dbw.Raw(ctx, "SELECT nsid, rkey, cid, value FROM records WHERE did = ? AND (nsid > ? OR (nsid = ? AND rkey > ?)) ORDER BY nsid ASC, rkey ASC LIMIT ?", nil, did, lastNsid, lastNsid, lastRkey, recordsBatchSize).Scan(&records).Error; err != nil {
+			return fmt.Errorf("error getting records: %w", err)
+		}
+
+		for _, rec := range records {
+			lastNsid, lastRkey = rec.Nsid, rec.Rkey
+			path := rec.Nsid + "/" + rec.Rkey
+
+			leaf, ok := leaves[path]
+			if !ok {
+				report.addProblem(ProblemRecordExtra, path, nil, "record with cid %s isn't in the mst", rec.Cid)
+				continue
+			}
+			found[path] = struct{}{}
+
+			if rec.Cid != leaf.String() {
+				report.addProblem(ProblemRecordMismatch, path, &leaf, "records table has cid %s", rec.Cid)
+				continue
+			}
+
+			sum, err := leaf.Prefix().Sum(rec.Value)
+			if err != nil || !sum.Equals(leaf) {
+				report.addProblem(ProblemRecordMismatch, path, &leaf, "records table value doesn't match its cid")
+			}
+		}
+
+		if len(records) < recordsBatchSize {
+			break
+		}
+	}
+
+	for _, path := range paths {
+		if _, ok := found[path]; !ok {
+			leaf := leaves[path]
+			report.addProblem(ProblemRecordMissing, path, &leaf, "record is missing from the records table")
+		}
+	}
+
+	return nil
+}
+
+// verifyBlobRefs counts the blob refs held by the records in the mst, and checks them against the blobs table
+func verifyBlobRefs(ctx context.Context, dbw *db.DB, bs *sqlite_blockstore.SqliteBlockstore, report *Report, did string, leaves map[string]cid.Cid, paths []string) error {
+	counts := map[cid.Cid]int{}
+	// the first record that references each blob, so a missing blob can be tracked down
+	refs := map[cid.Cid]string{}
+	var order []cid.Cid
+
+	for _, path := range paths {
+		leaf := leaves[path]
+
+		blk, err := bs.Get(ctx, leaf)
+		if err != nil {
+			return fmt.Errorf("error getting record %s: %w", path, err)
+		}
+
+		cids, err := blobstore.RecordBlobCids(blk.RawData())
+		if err != nil {
+			report.addProblem(ProblemRecordInvalid, path, &leaf, "%s", err)
+			continue
+		}
+
+		for _, c := range cids {
+			counts[c]++
+			if _, ok := refs[c]; !ok {
+				refs[c] = path
+				order = append(order, c)
+			}
+		}
+	}
+
+	var blobs []models.Blob
+	if err := dbw.Raw(ctx, "SELECT id, cid, ref_count FROM blobs WHERE did = ? ORDER BY id ASC", nil, did).Scan(&blobs).Error; err != nil {
+		return fmt.Errorf("error getting blobs: %w", err)
+	}
+	report.Blobs = len(blobs)
+
+	uploaded := map[cid.Cid]struct{}{}
+	for _, blob := range blobs {
+		// uploads that never finished don't have a cid, and can't be referenced
+		if blob.Cid == nil {
+			continue
+		}
+
+		c, err := cid.Cast(blob.Cid)
+		if err != nil {
+			continue
+		}
+		uploaded[c] = struct{}{}
+
+		if expected := counts[c]; blob.RefCount != expected {
+			report.addProblem(ProblemBlobRefCount, "", &c, "blob has a ref_count of %d but is referenced by %d records", blob.RefCount, expected)
+		}
+	}
+
+	for _, c := range order {
+		if _, ok := uploaded[c]; !ok {
+			report.addProblem(ProblemBlobMissing, refs[c], &c, "record references a blob that isn't in the blobs table")
+		}
+	}
+
+	return nil
+}
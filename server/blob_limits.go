@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/haileyok/cocoon/models"
+)
+
+const (
+	DefaultBlobMaxSize = 100_000_000
+
+	// DefaultBlobImageConcurrency is how many uploaded images are sanitized at the same time by default
+	DefaultBlobImageConcurrency = 4
+)
+
+// errBlobTooLarge is returned by a blobLimitReader once more than its limit has been read
+var errBlobTooLarge = errors.New("blob too large")
+
+type blobLimits struct {
+	maxSize int64
+	mimes   []blobMimeLimit
+	// quota is the default amount of blob storage each account gets. zero means unlimited
+	quota int64
+}
+
+type blobMimeLimit struct {
+	pattern string
+	size    int64
+}
+
+// parseBlobMimeLimits parses mime limits in the form of `image/*=1000000` or `video/mp4=100000000`
+func parseBlobMimeLimits(vals []string) ([]blobMimeLimit, error) {
+	var limits []blobMimeLimit
+	for _, v := range vals {
+		pattern, sizeStr, ok := strings.Cut(v, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid blob mime limit %q", v)
+		}
+
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size in blob mime limit %q", v)
+		}
+
+		limits = append(limits, blobMimeLimit{
+			pattern: strings.ToLower(pattern),
+			size:    size,
+		})
+	}
+	return limits, nil
+}
+
+// mimeLimit returns the limit for a mime type. an exact match wins over a wildcard like image/*
+func (bl *blobLimits) mimeLimit(mimeType string) (int64, bool) {
+	mimeType = strings.ToLower(mimeType)
+
+	var wildcard int64
+	for _, l := range bl.mimes {
+		if l.pattern == mimeType {
+			return l.size, true
+		}
+
+		if prefix, ok := strings.CutSuffix(l.pattern, "/*"); ok && strings.HasPrefix(mimeType, prefix+"/") {
+			wildcard = l.size
+		}
+	}
+
+	return wildcard, wildcard > 0
+}
+
+// blobQuota returns the blob storage quota of an account, taking an admin override into account. zero means unlimited
+func (s *Server) blobQuota(urepo *models.Repo) int64 {
+	if urepo.BlobQuota != nil {
+		return *urepo.BlobQuota
+	}
+	return s.blobLimits.quota
+}
+
+// blobStorageUsed returns the total size of all the blobs that an account has uploaded. blobs from before sizes were
+// stored count as 0 until their sizes have been backfilled, so known is false while any of those might still be left
+func (s *Server) blobStorageUsed(ctx context.Context, did string) (used int64, known bool, err error) {
+	var res struct {
+		Used    int64
+		Unknown int64
+	}
+	if err := s.db.Raw(ctx, "SELECT COALESCE(SUM(size), 0) AS used, COUNT(CASE WHEN size = 0 AND cid IS NOT NULL THEN 1 END) AS unknown FROM blobs WHERE did = ?", nil, did).Scan(&res).Error; err != nil {
+		return 0, false, err
+	}
+	return res.Used, res.Unknown == 0 || s.blobSizesBackfilled.Load(), nil
+}
+
+// blobLimitReader fails with errBlobTooLarge as soon as more than limit bytes have been read through it, so we stop
+// accepting a blob partway through rather than after it's already been stored
+type blobLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func newBlobLimitReader(r io.Reader, limit int64) *blobLimitReader {
+	return &blobLimitReader{
+		r:         r,
+		remaining: limit,
+	}
+}
+
+func (lr *blobLimitReader) Read(p []byte) (int, error) {
+	if lr.exceeded {
+		return 0, errBlobTooLarge
+	}
+
+	// read one byte past the limit, so that we can tell a blob that is exactly at the limit apart from one that's over
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		lr.exceeded = true
+		return 0, errBlobTooLarge
+	}
+
+	return n, err
+}
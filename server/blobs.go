@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+)
+
+const (
+	blobDeleteAttempts = 5
+	blobDeleteBackoff  = time.Second
+
+	// blobUploadTimeout is how long an upload that hasn't finished yet is left alone by the sweeper. these rows don't
+	// have a cid yet and are always unreferenced, so the normal grace period would delete them out from under a slow
+	// upload. once this has passed, the upload is assumed to have died along with the server
+	blobUploadTimeout = 24 * time.Hour
+)
+
+// deleteBlobData removes the data for blobs whose rows have already been deleted from the database. deletes that fail
+// are retried a few times with a backoff, since s3 can have the occasional hiccup. anything that still can't be removed
+// is left for reconciling to clean up later
+func (s *Server) deleteBlobData(ctx context.Context, blobs []models.Blob) {
+	for _, blob := range blobs {
+		s.deleteBlob(ctx, &blob)
+	}
+}
+
+// deleteBlob removes the data for a single blob whose row is already gone, and reports whether anything was deleted
+func (s *Server) deleteBlob(ctx context.Context, blob *models.Blob) bool {
+	bs, ok := s.blobstores[blob.Storage]
+	if !ok {
+		s.logger.Error("can't delete blob in a storage that isn't enabled", "did", blob.Did, "storage", blob.Storage)
+		return false
+	}
+
+	// an upload that never finished has no cid. s3 and disk only keep data under the cid, so there's nothing to remove
+	if blob.Cid == nil && blob.Storage != blobstore.StorageSqlite {
+		return false
+	}
+
+	backoff := blobDeleteBackoff
+	for attempt := 1; ; attempt++ {
+		shared, err := s.deleteUnsharedBlob(ctx, bs, blob)
+		if shared {
+			return false
+		}
+		if err == nil {
+			return true
+		}
+
+		if attempt == blobDeleteAttempts {
+			s.logger.Error("error deleting blob data, giving up", "did", blob.Did, "storage", blob.Storage, "attempts", attempt, "error", err)
+			return false
+		}
+
+		s.logger.Warn("error deleting blob data, retrying", "did", blob.Did, "storage", blob.Storage, "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// deleteUnsharedBlob deletes the data for a blob unless another row still needs it. this happens under the repo lock,
+// which is also what reserveBlob holds when it creates the row for a new upload. any upload that could write the same
+// data again either already has its row, which makes the data count as shared, or only starts once we're done
+func (s *Server) deleteUnsharedBlob(ctx context.Context, bs blobstore.Blobstore, blob *models.Blob) (bool, error) {
+	unlock := s.repoman.lockRepo(blob.Did)
+	defer unlock()
+
+	// the same blob may have been uploaded more than once, in which case the other rows still need the data
+	shared, err := blobstore.IsShared(ctx, s.db, blob)
+	if err != nil {
+		return false, fmt.Errorf("error checking if blob data is shared: %w", err)
+	}
+	if shared {
+		return true, nil
+	}
+
+	return false, bs.Delete(ctx, blob)
+}
+
+func (s *Server) blobGCRoutine(ctx context.Context) {
+	logger := s.logger.With("component", "blob-gc")
+
+	sweep := func() {
+		n, size, err := s.sweepBlobs(ctx)
+		if err != nil {
+			logger.Error("error sweeping unreferenced blobs", "err", err)
+		}
+		logger.Info("swept unreferenced blobs", "count", n, "bytes", size)
+	}
+
+	sweep()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweep()
+		}
+	}
+}
+
+// blobReconcileMinAge is how old data has to be before reconciling deletes it. it matches the default of
+// `cocoon blobs reconcile`
+const blobReconcileMinAge = 24 * time.Hour
+
+// blobReconcileRoutine runs alongside the sweeper and periodically deletes data in s3 or on disk that no blob row points
+// at anymore. that's what is left behind when the sweeper gives up on a delete, or the server goes down in between
+// deleting a row and its data
+func (s *Server) blobReconcileRoutine(ctx context.Context) {
+	if s.blobReconcileInterval <= 0 {
+		return
+	}
+
+	logger := s.logger.With("component", "blob-reconcile")
+
+	// reconciling lists everything in every store, so like compaction it doesn't run right away on startup
+	ticker := time.NewTicker(s.blobReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reconcileBlobs(ctx, logger)
+		}
+	}
+}
+
+// reconcileBlobs reconciles every enabled storage that can list what it holds
+func (s *Server) reconcileBlobs(ctx context.Context, logger *slog.Logger) {
+	for storage, bs := range s.blobstores {
+		lister, ok := bs.(blobstore.Lister)
+		if !ok {
+			continue
+		}
+
+		res, err := blobstore.Reconcile(ctx, s.db, blobstore.ReconcileArgs{
+			Storage: storage,
+			Store:   lister,
+			MinAge:  blobReconcileMinAge,
+			Logger:  logger,
+		})
+		if err != nil {
+			logger.Error("error reconciling blobs", "storage", storage, "err", err)
+			continue
+		}
+
+		logger.Info("reconciled blobs", "storage", storage, "checked", res.Checked, "orphans", res.Orphans, "bytes", res.Bytes, "failed", res.Failed)
+	}
+}
+
+// backfillBlobSizes fills in the sizes of blobs that were uploaded before sizes were stored. it runs once on startup,
+// and quotas aren't enforced against accounts that still have any of those blobs until it's done
+func (s *Server) backfillBlobSizes(ctx context.Context) {
+	logger := s.logger.With("component", "blob-size-backfill")
+
+	res, err := blobstore.BackfillSizes(ctx, s.db, blobstore.BackfillSizesArgs{
+		Stores: s.blobstores,
+		Logger: logger,
+	})
+	if err != nil {
+		logger.Error("error backfilling blob sizes", "err", err)
+		return
+	}
+
+	if res.Failed > 0 {
+		logger.Error("some blob sizes couldn't be backfilled, quotas won't be enforced for their accounts until the next restart", "failed", res.Failed)
+		return
+	}
+
+	s.blobSizesBackfilled.Store(true)
+
+	if res.Updated > 0 || res.Missing > 0 {
+		logger.Info("backfilled blob sizes", "checked", res.Checked, "updated", res.Updated, "missing", res.Missing)
+	}
+}
+
+// sweepBlobs deletes every blob that isn't referenced by any record and was uploaded longer than the grace period ago.
+// clients upload blobs before creating the record that uses them, so the grace period leaves them time to do so. it
+// returns the number of blobs that were deleted and how many bytes of storage were reclaimed
+func (s *Server) sweepBlobs(ctx context.Context) (int, int64, error) {
+	// blob created_at values are tids, so they can be compared against a tid for the cutoff
+	cutoffs := blobSweepCutoffs{
+		done:    syntax.NewTID(time.Now().Add(-s.blobGCGrace).UnixMicro(), 0).String(),
+		pending: syntax.NewTID(time.Now().Add(-max(s.blobGCGrace, blobUploadTimeout)).UnixMicro(), 0).String(),
+	}
+
+	var dids []string
+	if err := s.db.Raw(ctx, "SELECT DISTINCT did FROM blobs WHERE "+blobSweepCondition, nil, cutoffs.done, cutoffs.pending).Scan(&dids).Error; err != nil {
+		return 0, 0, err
+	}
+
+	var count int
+	var reclaimed int64
+	for _, did := range dids {
+		if err := ctx.Err(); err != nil {
+			return count, reclaimed, err
+		}
+
+		n, size, err := s.sweepRepoBlobs(ctx, did, cutoffs)
+		if err != nil {
+			s.logger.Error("error sweeping blobs for repo", "did", did, "error", err)
+			continue
+		}
+
+		count += n
+		reclaimed += size
+	}
+
+	return count, reclaimed, nil
+}
+
+func (s *Server) sweepRepoBlobs(ctx context.Context, did string, cutoffs blobSweepCutoffs) (int, int64, error) {
+	blobs, err := s.deleteUnreferencedBlobs(ctx, did, cutoffs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var reclaimed int64
+	for _, blob := range blobs {
+		// the size has to be read before the data is gone. sqlite parts can still be read after the row is deleted
+		var size int64
+		if bs, ok := s.blobstores[blob.Storage]; ok && (blob.Cid != nil || blob.Storage == blobstore.StorageSqlite) {
+			if info, err := bs.Stat(ctx, &blob); err == nil {
+				size = info.Size
+			}
+		}
+
+		if s.deleteBlob(ctx, &blob) {
+			reclaimed += size
+		}
+	}
+
+	return len(blobs), reclaimed, nil
+}
+
+// blobSweepCutoffs are the tids that a blob has to have been created before for it to be swept. uploads that have
+// finished use done, uploads that haven't use pending
+type blobSweepCutoffs struct {
+	done    string
+	pending string
+}
+
+// blobSweepCondition matches the blobs that can be swept, given the done and pending cutoffs as arguments
+const blobSweepCondition = "ref_count <= 0 AND ((cid IS NOT NULL AND created_at < ?) OR (cid IS NULL AND created_at < ?))"
+
+// deleteUnreferencedBlobs deletes the rows of every blob in a repo that has no refs and was uploaded before the cutoffs,
+// returning the deleted rows
+func (s *Server) deleteUnreferencedBlobs(ctx context.Context, did string, cutoffs blobSweepCutoffs) ([]models.Blob, error) {
+	// holding the repo lock means no record can pick up a ref to one of these blobs while we're deleting it
+	unlock := s.repoman.lockRepo(did)
+	defer unlock()
+
+	// a blob with no refs is about to be deleted for good, so make sure the count is actually right first. repos that
+	// were written before refs were counted can have referenced blobs sitting at zero. once a repo has been recounted,
+	// every write keeps its counts up to date, so that only has to happen once
+	var counted []bool
+	if err := s.db.Raw(ctx, "SELECT blob_refs_counted FROM repos WHERE did = ?", nil, did).Scan(&counted).Error; err != nil {
+		return nil, err
+	}
+	if len(counted) == 0 || !counted[0] {
+		if _, err := blobstore.RecountRefs(ctx, s.db, did); err != nil {
+			return nil, err
+		}
+	}
+
+	var blobs []models.Blob
+	if err := s.db.Transaction(ctx, func(tx *db.DB) error {
+		if err := tx.Raw(ctx, "SELECT * FROM blobs WHERE did = ? AND "+blobSweepCondition, nil, did, cutoffs.done, cutoffs.pending).Scan(&blobs).Error; err != nil {
+			return err
+		}
+
+		for _, blob := range blobs {
+			if err := tx.Exec(ctx, "DELETE FROM blobs WHERE id = ?", nil, blob.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
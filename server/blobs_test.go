@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+)
+
+func TestSweepBlobsKeepsPendingUploads(t *testing.T) {
+	s := newTestServer(t)
+	s.blobGCGrace = time.Hour
+
+	ctx := context.Background()
+
+	createdAgo := func(d time.Duration) string {
+		return syntax.NewTID(time.Now().Add(-d).UnixMicro(), 0).String()
+	}
+
+	c, err := cid.Decode("bafkreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := map[string]*models.Blob{
+		"finished":  {Did: "did:plc:test", Cid: c.Bytes(), CreatedAt: createdAgo(2 * time.Hour)},
+		"uploading": {Did: "did:plc:test", CreatedAt: createdAgo(2 * time.Hour)},
+		"abandoned": {Did: "did:plc:test", CreatedAt: createdAgo(blobUploadTimeout + time.Hour)},
+		"recent":    {Did: "did:plc:test", Cid: c.Bytes(), CreatedAt: createdAgo(time.Minute)},
+	}
+	for _, blob := range blobs {
+		if err := s.db.Create(ctx, blob, nil).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, _, err := s.sweepBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swept := map[string]bool{"finished": true, "abandoned": true}
+	if n != len(swept) {
+		t.Errorf("expected %d blobs to be swept, got %d", len(swept), n)
+	}
+
+	for name, blob := range blobs {
+		var count int64
+		if err := s.db.Raw(ctx, "SELECT COUNT(*) FROM blobs WHERE id = ?", nil, blob.ID).Scan(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if swept[name] && count != 0 {
+			t.Errorf("expected %s blob to be swept", name)
+		} else if !swept[name] && count == 0 {
+			t.Errorf("expected %s blob to be kept", name)
+		}
+	}
+}
+
+func TestDeleteBlobKeepsDataForPendingUploads(t *testing.T) {
+	s := newTestServer(t)
+
+	disk, err := blobstore.NewDisk(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.blobstores[blobstore.StorageDisk] = disk
+
+	ctx := context.Background()
+
+	blob := models.Blob{
+		Did:       "did:plc:test",
+		CreatedAt: s.repoman.clock.Next().String(),
+		Storage:   blobstore.StorageDisk,
+	}
+	c, _, err := disk.Put(ctx, &blob, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob.Cid = c.Bytes()
+
+	// another upload for the same repo hasn't finished yet, so it could be writing the same data again
+	uploading := models.Blob{
+		Did:       blob.Did,
+		CreatedAt: s.repoman.clock.Next().String(),
+		Storage:   blobstore.StorageDisk,
+	}
+	if err := s.db.Create(ctx, &uploading, nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if s.deleteBlob(ctx, &blob) {
+		t.Error("expected data to be kept while an upload is in flight")
+	}
+	if ok, err := disk.Exists(ctx, &blob); err != nil || !ok {
+		t.Fatalf("expected data to still exist, got %v (err: %v)", ok, err)
+	}
+
+	if err := s.db.Exec(ctx, "DELETE FROM blobs WHERE id = ?", nil, uploading.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.deleteBlob(ctx, &blob) {
+		t.Error("expected data to be deleted once nothing else needs it")
+	}
+	if ok, err := disk.Exists(ctx, &blob); err != nil || ok {
+		t.Errorf("expected data to be gone, got %v (err: %v)", ok, err)
+	}
+}
+
+func TestSweepBlobsRecountsRefsOnce(t *testing.T) {
+	s := newTestServer(t)
+	s.blobGCGrace = time.Hour
+	urepo := createTestRepo(t, s, "did:plc:test")
+
+	ctx := context.Background()
+
+	c, err := cid.Decode("bafkreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createBlob := func(refs int) *models.Blob {
+		t.Helper()
+
+		blob := &models.Blob{
+			Did:       urepo.Did,
+			Cid:       c.Bytes(),
+			RefCount:  refs,
+			CreatedAt: syntax.NewTID(time.Now().Add(-2*time.Hour).UnixMicro(), 0).String(),
+		}
+		if err := s.db.Create(ctx, blob, nil).Error; err != nil {
+			t.Fatal(err)
+		}
+		return blob
+	}
+
+	sweep := func() int {
+		t.Helper()
+
+		n, _, err := s.sweepBlobs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	setCounted := func(counted bool) {
+		t.Helper()
+
+		if err := s.db.Exec(ctx, "UPDATE repos SET blob_refs_counted = ? WHERE did = ?", nil, counted, urepo.Did).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing references this blob, but its count says otherwise. that only gets noticed by recounting
+	miscounted := createBlob(3)
+
+	// once a repo has been counted, the sweeper trusts the counts it has
+	setCounted(true)
+	createBlob(0)
+	if n := sweep(); n != 1 {
+		t.Fatalf("expected only the unreferenced blob to be swept from a counted repo, got %d", n)
+	}
+
+	var refs int
+	if err := s.db.Raw(ctx, "SELECT ref_count FROM blobs WHERE id = ?", nil, miscounted.ID).Scan(&refs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if refs != 3 {
+		t.Errorf("expected a counted repo not to be recounted, but the ref count went from 3 to %d", refs)
+	}
+
+	setCounted(false)
+	createBlob(0)
+	if n := sweep(); n != 2 {
+		t.Fatalf("expected the miscounted blob to be swept after recounting, got %d", n)
+	}
+
+	var counted bool
+	if err := s.db.Raw(ctx, "SELECT blob_refs_counted FROM repos WHERE did = ?", nil, urepo.Did).Scan(&counted).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !counted {
+		t.Error("expected the repo to be marked as counted")
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"github.com/haileyok/cocoon/internal/db"
 	"github.com/haileyok/cocoon/sqlite_blockstore"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 )
@@ -20,11 +21,40 @@ func MustReturnBlockstoreVariant(maybeBsv string) BlockstoreVariant {
 	}
 }
 
+// getBlockstore returns a blockstore for reading from the db. it can't be written to, since writes need to be tagged
+// with a commit rev. use getTxBlockstore for that
 func (s *Server) getBlockstore(did string) blockstore.Blockstore {
+	return s.getTxBlockstore(s.db, did, "")
+}
+
+// getReadOnlyBlockstore returns a blockstore that reads from the db, but only keeps writes in memory
+func (s *Server) getReadOnlyBlockstore(did string) blockstore.Blockstore {
+	switch s.config.BlockstoreVariant {
+	case BlockstoreVariantSqlite:
+		bs := sqlite_blockstore.NewReadOnly(did, s.db)
+		bs.SetCache(s.blockCache, true)
+		return bs
+	default:
+		bs := sqlite_blockstore.NewReadOnly(did, s.db)
+		bs.SetCache(s.blockCache, true)
+		return bs
+	}
+}
+
+// getTxBlockstore returns a blockstore that reads and writes through the given db, which is usually a transaction.
+// written blocks are tagged with rev, which should be the rev of the commit they belong to
+func (s *Server) getTxBlockstore(tx *db.DB, did, rev string) blockstore.Blockstore {
 	switch s.config.BlockstoreVariant {
 	case BlockstoreVariantSqlite:
-		return sqlite_blockstore.New(did, s.db)
+		bs := sqlite_blockstore.New(did, tx)
+		bs.SetRev(rev)
+		// reads inside a transaction can see blocks that haven't been committed yet, so those don't go into the cache
+		bs.SetCache(s.blockCache, tx == s.db)
+		return bs
 	default:
-		return sqlite_blockstore.New(did, s.db)
+		bs := sqlite_blockstore.New(did, tx)
+		bs.SetRev(rev)
+		bs.SetCache(s.blockCache, tx == s.db)
+		return bs
 	}
 }
@@ -78,7 +78,6 @@ func (s *Server) handleSubmitPlcOperation(e echo.Context) error {
 	s.evtman.AddEvent(context.TODO(), &events.XRPCStreamEvent{
 		RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
 			Did:  repo.Repo.Did,
-			Seq:  time.Now().UnixMicro(), // TODO: no
 			Time: time.Now().Format(util.ISO8601),
 		},
 	})
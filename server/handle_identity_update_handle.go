@@ -89,7 +89,6 @@ func (s *Server) handleIdentityUpdateHandle(e echo.Context) error {
 		RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
 			Did:    repo.Repo.Did,
 			Handle: to.StringPtr(req.Handle),
-			Seq:    time.Now().UnixMicro(), // TODO: no
 			Time:   time.Now().Format(util.ISO8601),
 		},
 	})
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/google/uuid"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/internal/helpers"
+	"github.com/haileyok/cocoon/models"
+	"github.com/labstack/echo/v4"
+)
+
+// importUploadTimeout is how long a car upload for an import job gets before the connection is closed
+const importUploadTimeout = time.Hour
+
+type ImportJobResponse struct {
+	JobID     string  `json:"jobId"`
+	State     string  `json:"state"`
+	Blocks    int64   `json:"blocks"`
+	Records   int64   `json:"records"`
+	Error     *string `json:"error,omitempty"`
+	CreatedAt string  `json:"createdAt"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+func (s *Server) importJobResponse(job *models.ImportJob) ImportJobResponse {
+	resp := ImportJobResponse{
+		JobID:     job.ID,
+		State:     job.State,
+		Blocks:    job.Blocks,
+		Records:   job.Records,
+		CreatedAt: job.CreatedAt.Format(time.RFC3339Nano),
+		UpdatedAt: job.UpdatedAt.Format(time.RFC3339Nano),
+	}
+
+	if job.Error != "" {
+		resp.Error = to.StringPtr(job.Error)
+	}
+
+	// the counts in the db are only saved once a job is finished
+	if v, ok := s.importsRunning.Load(job.ID); ok {
+		progress := v.(*importProgress)
+		resp.Blocks = progress.blocks.Load()
+		resp.Records = progress.records.Load()
+	}
+
+	return resp
+}
+
+// handleStartImportJob spools the car in the request body to disk and queues it to be imported in the background. it
+// takes the same body as com.atproto.repo.importRepo, but returns as soon as the car has been received
+func (s *Server) handleStartImportJob(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	urepo := e.Get("repo").(*models.RepoActor)
+
+	// checked before the car is uploaded so that nobody waits on an upload that's going to be thrown away, and then again
+	// when the job is created in case another one was started in the meantime
+	if err := s.checkNoActiveImport(ctx, s.db, urepo.Repo.Did); err != nil {
+		return s.handleStartImportJobError(e, err)
+	}
+
+	if e.Request().ContentLength > s.importMaxSize {
+		return importTooLargeError(e, s.importMaxSize)
+	}
+
+	// a large car can take much longer to upload than the server's timeouts allow for every other request
+	rc := http.NewResponseController(e.Response())
+	if err := rc.SetReadDeadline(time.Now().Add(importUploadTimeout)); err != nil {
+		s.logger.Error("error extending import read deadline", "error", err)
+	}
+	if err := rc.SetWriteDeadline(time.Now().Add(importUploadTimeout)); err != nil {
+		s.logger.Error("error extending import write deadline", "error", err)
+	}
+
+	id := uuid.NewString()
+	path := s.importSpoolPath(id)
+
+	f, err := os.Create(path)
+	if err != nil {
+		s.logger.Error("error creating spool file", "error", err)
+		return helpers.ServerError(e, nil)
+	}
+
+	lr := newBlobLimitReader(e.Request().Body, s.importMaxSize)
+	if _, err := io.Copy(f, lr); err != nil {
+		f.Close()
+		os.Remove(path)
+		if lr.exceeded {
+			return importTooLargeError(e, s.importMaxSize)
+		}
+		s.logger.Error("error spooling repo import", "did", urepo.Repo.Did, "error", err)
+		return helpers.ServerError(e, nil)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		s.logger.Error("error closing spool file", "error", err)
+		return helpers.ServerError(e, nil)
+	}
+
+	job := models.ImportJob{
+		ID:    id,
+		Did:   urepo.Repo.Did,
+		State: importStateQueued,
+	}
+
+	if err := s.db.Transaction(ctx, func(tx *db.DB) error {
+		if err := s.checkNoActiveImport(ctx, tx, urepo.Repo.Did); err != nil {
+			return err
+		}
+
+		return tx.Create(ctx, &job, nil).Error
+	}); err != nil {
+		os.Remove(path)
+		return s.handleStartImportJobError(e, err)
+	}
+
+	s.wakeImports()
+
+	return e.JSON(200, s.importJobResponse(&job))
+}
+
+func (s *Server) handleStartImportJobError(e echo.Context, err error) error {
+	if errors.Is(err, errImportInProgress) {
+		return e.JSON(400, map[string]string{
+			"error":   "ImportInProgress",
+			"message": err.Error(),
+		})
+	}
+
+	s.logger.Error("error creating import job", "error", err)
+	return helpers.ServerError(e, nil)
+}
+
+func importTooLargeError(e echo.Context, max int64) error {
+	return e.JSON(400, map[string]string{
+		"error":   "InvalidRequest",
+		"message": fmt.Sprintf("This repo is too large to import. The maximum size is %d bytes", max),
+	})
+}
+
+// handleGetImportJob returns the state of one of the account's import jobs
+func (s *Server) handleGetImportJob(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	urepo := e.Get("repo").(*models.RepoActor)
+
+	id := e.Param("id")
+
+	var job models.ImportJob
+	res := s.db.Raw(ctx, "SELECT * FROM import_jobs WHERE id = ? AND did = ?", nil, id, urepo.Repo.Did).Scan(&job)
+	if res.Error != nil {
+		s.logger.Error("error getting import job", "error", res.Error)
+		return helpers.ServerError(e, nil)
+	}
+	if res.RowsAffected == 0 {
+		return helpers.InputError(e, to.StringPtr("ImportJobNotFound"))
+	}
+
+	return e.JSON(200, s.importJobResponse(&job))
+}
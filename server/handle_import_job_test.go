@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/haileyok/cocoon/models"
+	"github.com/labstack/echo/v4"
+)
+
+func startImportJob(t *testing.T, s *Server, urepo models.Repo, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/import/jobs", body)
+	req.Header.Set("content-type", "application/vnd.ipld.car")
+	rec := httptest.NewRecorder()
+
+	c := echo.New().NewContext(req, rec)
+	c.Set("repo", &models.RepoActor{Repo: urepo})
+
+	if err := s.handleStartImportJob(c); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec
+}
+
+func spooledCars(t *testing.T, s *Server) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(s.importSpoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(entries)
+}
+
+func TestStartImportJob(t *testing.T) {
+	s := newTestServer(t)
+	s.importSpoolDir = t.TempDir()
+	s.importMaxSize = 100
+	s.importWake = make(chan struct{}, 1)
+
+	urepo := createTestRepo(t, s, "did:plc:test")
+	other := createTestRepo(t, s, "did:plc:other")
+
+	// the body is streamed without a content length, so the limit has to be caught while it's being spooled
+	rec := startImportJob(t, s, urepo, io.NopCloser(bytes.NewReader(make([]byte, 101))))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a car over the limit to be rejected, got %d", rec.Code)
+	}
+	if n := spooledCars(t, s); n != 0 {
+		t.Errorf("expected the rejected car to be removed, found %d spooled cars", n)
+	}
+
+	rec = startImportJob(t, s, urepo, bytes.NewReader(make([]byte, 100)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a car at the limit to be queued, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var job ImportJobResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.State != importStateQueued {
+		t.Errorf("expected job to be queued, got %s", job.State)
+	}
+
+	// the account's first job hasn't run yet
+	rec = startImportJob(t, s, urepo, bytes.NewReader(make([]byte, 10)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a second job to be rejected, got %d", rec.Code)
+	}
+
+	// other accounts aren't held up by it
+	rec = startImportJob(t, s, other, bytes.NewReader(make([]byte, 10)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected another account's job to be queued, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// once the job is finished a new one can be started
+	if err := s.db.Exec(context.Background(), "UPDATE import_jobs SET state = ? WHERE id = ?", nil, importStateFailed, job.JobID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec = startImportJob(t, s, urepo, bytes.NewReader(make([]byte, 10)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a job to be queued after the last one finished, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if n := spooledCars(t, s); n != 3 {
+		t.Errorf("expected 3 spooled cars, found %d", n)
+	}
+}
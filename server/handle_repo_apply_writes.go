@@ -1,6 +1,9 @@
 package server
 
 import (
+	"errors"
+
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/haileyok/cocoon/models"
 	"github.com/labstack/echo/v4"
@@ -8,7 +11,7 @@ import (
 
 type ComAtprotoRepoApplyWritesInput struct {
 	Repo       string                          `json:"repo" validate:"required,atproto-did"`
-	Validate   *bool                           `json:"bool,omitempty"`
+	Validate   *bool                           `json:"validate,omitempty"`
 	Writes     []ComAtprotoRepoApplyWritesItem `json:"writes"`
 	SwapCommit *string                         `json:"swapCommit"`
 }
@@ -52,14 +55,14 @@ func (s *Server) handleApplyWrites(e echo.Context) error {
 			Type:       OpType(item.Type),
 			Collection: item.Collection,
 			Rkey:       &item.Rkey,
+			Validate:   req.Validate,
 			Record:     item.Value,
 		})
 	}
 
 	results, err := s.repoman.applyWrites(ctx, repo.Repo, ops, req.SwapCommit)
 	if err != nil {
-		s.logger.Error("error applying writes", "error", err)
-		return helpers.ServerError(e, nil)
+		return s.handleApplyWritesError(e, err)
 	}
 
 	commit := *results[0].Commit
@@ -73,3 +76,19 @@ func (s *Server) handleApplyWrites(e echo.Context) error {
 		Results: results,
 	})
 }
+
+// handleApplyWritesError maps errors returned from applyWrites to the xrpc errors that clients expect
+func (s *Server) handleApplyWritesError(e echo.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidSwap):
+		return helpers.InputError(e, to.StringPtr("InvalidSwap"))
+	case errors.Is(err, ErrInvalidRecord):
+		return e.JSON(400, map[string]string{
+			"error":   "InvalidRequest",
+			"message": err.Error(),
+		})
+	default:
+		s.logger.Error("error applying writes", "error", err)
+		return helpers.ServerError(e, nil)
+	}
+}
@@ -10,7 +10,7 @@ type ComAtprotoRepoCreateRecordInput struct {
 	Repo       string         `json:"repo" validate:"required,atproto-did"`
 	Collection string         `json:"collection" validate:"required,atproto-nsid"`
 	Rkey       *string        `json:"rkey,omitempty"`
-	Validate   *bool          `json:"bool,omitempty"`
+	Validate   *bool          `json:"validate,omitempty"`
 	Record     MarshalableMap `json:"record" validate:"required"`
 	SwapRecord *string        `json:"swapRecord"`
 	SwapCommit *string        `json:"swapCommit"`
@@ -49,12 +49,11 @@ func (s *Server) handleCreateRecord(e echo.Context) error {
 			Rkey:       req.Rkey,
 			Validate:   req.Validate,
 			Record:     &req.Record,
-			SwapRecord: req.SwapRecord,
+			SwapRecord: NullableString{Set: req.SwapRecord != nil, Value: req.SwapRecord},
 		},
 	}, req.SwapCommit)
 	if err != nil {
-		s.logger.Error("error applying writes", "error", err)
-		return helpers.ServerError(e, nil)
+		return s.handleApplyWritesError(e, err)
 	}
 
 	results[0].Type = nil
@@ -40,12 +40,11 @@ func (s *Server) handleDeleteRecord(e echo.Context) error {
 			Type:       OpTypeDelete,
 			Collection: req.Collection,
 			Rkey:       &req.Rkey,
-			SwapRecord: req.SwapRecord,
+			SwapRecord: NullableString{Set: req.SwapRecord != nil, Value: req.SwapRecord},
 		},
 	}, req.SwapCommit)
 	if err != nil {
-		s.logger.Error("error applying writes", "error", err)
-		return helpers.ServerError(e, nil)
+		return s.handleApplyWritesError(e, err)
 	}
 
 	results[0].Type = nil
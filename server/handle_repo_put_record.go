@@ -10,9 +10,9 @@ type ComAtprotoRepoPutRecordInput struct {
 	Repo       string         `json:"repo" validate:"required,atproto-did"`
 	Collection string         `json:"collection" validate:"required,atproto-nsid"`
 	Rkey       string         `json:"rkey" validate:"required,atproto-rkey"`
-	Validate   *bool          `json:"bool,omitempty"`
+	Validate   *bool          `json:"validate,omitempty"`
 	Record     MarshalableMap `json:"record" validate:"required"`
-	SwapRecord *string        `json:"swapRecord"`
+	SwapRecord NullableString `json:"swapRecord"`
 	SwapCommit *string        `json:"swapCommit"`
 }
 
@@ -38,7 +38,7 @@ func (s *Server) handlePutRecord(e echo.Context) error {
 	}
 
 	optype := OpTypeCreate
-	if req.SwapRecord != nil {
+	if req.SwapRecord.Value != nil {
 		optype = OpTypeUpdate
 	}
 
@@ -53,8 +53,7 @@ func (s *Server) handlePutRecord(e echo.Context) error {
 		},
 	}, req.SwapCommit)
 	if err != nil {
-		s.logger.Error("error applying writes", "error", err)
-		return helpers.ServerError(e, nil)
+		return s.handleApplyWritesError(e, err)
 	}
 
 	results[0].Type = nil
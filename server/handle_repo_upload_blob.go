@@ -1,23 +1,21 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/image_sanitizer"
 	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/haileyok/cocoon/models"
-	"github.com/ipfs/go-cid"
 	"github.com/labstack/echo/v4"
-	"github.com/multiformats/go-multihash"
-)
-
-const (
-	blockSize = 0x10000
 )
 
 type ComAtprotoRepoUploadBlobResponse struct {
@@ -31,119 +29,209 @@ type ComAtprotoRepoUploadBlobResponse struct {
 	} `json:"blob"`
 }
 
+// sanitizeImage reads an uploaded image and strips its metadata. the whole image has to be in memory to check it, and
+// decoding it takes even more, so only so many are handled at once
+func (s *Server) sanitizeImage(ctx context.Context, r io.Reader, mimeType string) ([]byte, error) {
+	select {
+	case s.imageSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.imageSlots }()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image: %w", err)
+	}
+
+	return image_sanitizer.Sanitize(mimeType, data, *s.imageOpts)
+}
+
 func (s *Server) handleRepoUploadBlob(e echo.Context) error {
 	ctx := e.Request().Context()
 
 	urepo := e.Get("repo").(*models.RepoActor)
 
-	mime := e.Request().Header.Get("content-type")
-	if mime == "" {
-		mime = "application/octet-stream"
+	// peeking doesn't consume anything, so the sniffed bytes still get stored along with the rest of the body
+	body := bufio.NewReaderSize(e.Request().Body, 512)
+	head, _ := body.Peek(512)
+
+	mimeType := blobMimeType(e.Request().Header.Get("content-type"), head)
+
+	blob, limit, err := s.reserveBlob(ctx, &urepo.Repo, mimeType, e.Request().ContentLength)
+	if err != nil {
+		s.logger.Error("error reserving blob", "error", err)
+		return helpers.ServerError(e, nil)
 	}
+	if blob == nil {
+		return blobTooLargeError(e, limit)
+	}
+
+	lr := newBlobLimitReader(body, limit.size)
+
+	var src io.Reader = lr
+	if s.imageOpts != nil && image_sanitizer.Supported(mimeType) {
+		// we store and hash the sanitized bytes, so the cid that we hand back always matches what's stored
+		clean, err := s.sanitizeImage(ctx, lr, mimeType)
+		if err != nil {
+			s.deleteRejectedBlob(ctx, blob)
+			if lr.exceeded {
+				return blobTooLargeError(e, limit)
+			}
+			if errors.Is(err, image_sanitizer.ErrInvalidImage) {
+				return e.JSON(400, map[string]string{
+					"error":   "InvalidRequest",
+					"message": err.Error(),
+				})
+			}
+			s.logger.Error("error sanitizing image", "error", err)
+			return helpers.ServerError(e, nil)
+		}
 
-	storage := "sqlite"
-	s3Upload := s.s3Config != nil && s.s3Config.BlobstoreEnabled
-	if s3Upload {
-		storage = "s3"
+		src = bytes.NewReader(clean)
 	}
-	blob := models.Blob{
-		Did:       urepo.Repo.Did,
-		RefCount:  0,
-		CreatedAt: s.repoman.clock.Next().String(),
-		Storage:   storage,
+
+	// the blobstore computes the cid as the body streams through, so we never hold the whole blob in memory
+	c, size, err := s.blobstores[blob.Storage].Put(ctx, blob, src)
+	if err != nil {
+		// nothing references a blob that didn't make it, so get rid of whatever was already written for it along with
+		// its reservation
+		s.deleteRejectedBlob(ctx, blob)
+		if lr.exceeded {
+			return blobTooLargeError(e, limit)
+		}
+		s.logger.Error("error storing blob", "storage", blob.Storage, "error", err)
+		return helpers.ServerError(e, nil)
 	}
 
-	if err := s.db.Create(ctx, &blob, nil).Error; err != nil {
-		s.logger.Error("error creating new blob in db", "error", err)
+	// the reserved size gets replaced with the actual size now that we know it
+	if err := s.db.Exec(ctx, "UPDATE blobs SET cid = ?, size = ? WHERE id = ?", nil, c.Bytes(), size, blob.ID).Error; err != nil {
+		// there should probably be somme handling here if this fails...
+		s.logger.Error("error updating blob", "error", err)
 		return helpers.ServerError(e, nil)
 	}
 
-	read := 0
-	part := 0
+	resp := ComAtprotoRepoUploadBlobResponse{}
+	resp.Blob.Type = "blob"
+	resp.Blob.Ref.Link = c.String()
+	resp.Blob.MimeType = mimeType
+	resp.Blob.Size = int(size)
 
-	buf := make([]byte, 0x10000)
-	fulldata := new(bytes.Buffer)
+	return e.JSON(200, resp)
+}
 
-	for {
-		n, err := io.ReadFull(e.Request().Body, buf)
-		if err == io.ErrUnexpectedEOF || err == io.EOF {
-			if n == 0 {
-				break
-			}
-		} else if err != nil && err != io.ErrUnexpectedEOF {
-			s.logger.Error("error reading blob", "error", err)
-			return helpers.ServerError(e, nil)
-		}
+type blobUploadLimit struct {
+	size int64
+	// quota is set when the limit comes from the account's remaining storage, rather than a size limit
+	quota bool
+}
 
-		data := buf[:n]
-		read += n
-		fulldata.Write(data)
+// blobUploadLimit works out the largest blob an account can upload right now. that's the smallest of the global size
+// limit, the limit for the blob's mime type and whatever is left of the account's storage quota
+func (s *Server) blobUploadLimit(ctx context.Context, urepo *models.Repo, mimeType string) (blobUploadLimit, error) {
+	limit := blobUploadLimit{size: s.blobLimits.maxSize}
 
-		if !s3Upload {
-			blobPart := models.BlobPart{
-				BlobID: blob.ID,
-				Idx:    part,
-				Data:   data,
-			}
+	if ml, ok := s.blobLimits.mimeLimit(mimeType); ok && ml < limit.size {
+		limit.size = ml
+	}
 
-			if err := s.db.Create(ctx, &blobPart, nil).Error; err != nil {
-				s.logger.Error("error adding blob part to db", "error", err)
-				return helpers.ServerError(e, nil)
-			}
+	if quota := s.blobQuota(urepo); quota > 0 {
+		used, known, err := s.blobStorageUsed(ctx, urepo.Did)
+		if err != nil {
+			return limit, err
 		}
-		part++
 
-		if n < blockSize {
-			break
+		// an account would get more than its quota if we went by sizes that haven't been backfilled yet, and we don't want
+		// to wrongly turn away uploads either, so the quota isn't enforced until they have been
+		if remaining := quota - used; known && remaining < limit.size {
+			limit.size = max(remaining, 0)
+			limit.quota = true
 		}
 	}
 
-	c, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(fulldata.Bytes())
+	return limit, nil
+}
+
+// reserveBlob checks an upload against the account's limits and creates its row. until the upload is done, the row's
+// size is the most that the upload can take up. the check and the insert both happen under the repo lock, so uploads
+// that run at the same time see each other's reservations and can't use up the same part of the quota. a nil blob is
+// returned if the upload is too large
+func (s *Server) reserveBlob(ctx context.Context, urepo *models.Repo, mimeType string, contentLength int64) (*models.Blob, blobUploadLimit, error) {
+	unlock := s.repoman.lockRepo(urepo.Did)
+	defer unlock()
+
+	limit, err := s.blobUploadLimit(ctx, urepo, mimeType)
 	if err != nil {
-		s.logger.Error("error creating cid prefix", "error", err)
-		return helpers.ServerError(e, nil)
+		return nil, limit, err
 	}
 
-	if s3Upload {
-		config := &aws.Config{
-			Region:      aws.String(s.s3Config.Region),
-			Credentials: credentials.NewStaticCredentials(s.s3Config.AccessKey, s.s3Config.SecretKey, ""),
-		}
+	if limit.size <= 0 || contentLength > limit.size {
+		return nil, limit, nil
+	}
 
-		if s.s3Config.Endpoint != "" {
-			config.Endpoint = aws.String(s.s3Config.Endpoint)
-			config.S3ForcePathStyle = aws.Bool(true)
-		}
+	// the content length is -1 when the client didn't send one
+	reserved := limit.size
+	if contentLength >= 0 {
+		reserved = contentLength
+	}
 
-		sess, err := session.NewSession(config)
-		if err != nil {
-			s.logger.Error("error creating aws session", "error", err)
-			return helpers.ServerError(e, nil)
-		}
+	blob := models.Blob{
+		Did:       urepo.Did,
+		RefCount:  0,
+		CreatedAt: s.repoman.clock.Next().String(),
+		Storage:   s.blobStorage,
+		MimeType:  mimeType,
+		Size:      reserved,
+	}
 
-		svc := s3.New(sess)
+	if err := s.db.Create(ctx, &blob, nil).Error; err != nil {
+		return nil, limit, err
+	}
 
-		if _, err := svc.PutObject(&s3.PutObjectInput{
-			Bucket: aws.String(s.s3Config.Bucket),
-			Key:    aws.String(fmt.Sprintf("blobs/%s/%s", urepo.Repo.Did, c.String())),
-			Body:   bytes.NewReader(fulldata.Bytes()),
-		}); err != nil {
-			s.logger.Error("error uploading blob to s3", "error", err)
-			return helpers.ServerError(e, nil)
+	return &blob, limit, nil
+}
+
+func blobTooLargeError(e echo.Context, limit blobUploadLimit) error {
+	msg := fmt.Sprintf("This file is too large. The maximum size is %d bytes", limit.size)
+	if limit.quota {
+		msg = fmt.Sprintf("This file would exceed your blob storage quota, which has %d bytes remaining", limit.size)
+	}
+
+	return e.JSON(400, map[string]string{
+		"error":   "BlobTooLarge",
+		"message": msg,
+	})
+}
+
+// deleteRejectedBlob removes a blob that was rejected or failed partway through being uploaded, which also frees up its
+// reservation. s3 and disk clean up their own temporary data when a put fails, but sqlite parts are written as they come
+// in
+func (s *Server) deleteRejectedBlob(ctx context.Context, blob *models.Blob) {
+	if blob.Storage == blobstore.StorageSqlite {
+		if err := s.blobstores[blob.Storage].Delete(ctx, blob); err != nil {
+			s.logger.Error("error deleting rejected blob parts", "error", err)
+			return
 		}
 	}
 
-	if err := s.db.Exec(ctx, "UPDATE blobs SET cid = ? WHERE id = ?", nil, c.Bytes(), blob.ID).Error; err != nil {
-		// there should probably be somme handling here if this fails...
-		s.logger.Error("error updating blob", "error", err)
-		return helpers.ServerError(e, nil)
+	if err := s.db.Exec(ctx, "DELETE FROM blobs WHERE id = ?", nil, blob.ID).Error; err != nil {
+		s.logger.Error("error deleting rejected blob", "error", err)
 	}
+}
 
-	resp := ComAtprotoRepoUploadBlobResponse{}
-	resp.Blob.Type = "blob"
-	resp.Blob.Ref.Link = c.String()
-	resp.Blob.MimeType = mime
-	resp.Blob.Size = read
+// blobMimeType works out the mime type of a blob from the first bytes of its content, falling back to the content type
+// the client sent. binary formats are easy to recognize, so whatever we sniff wins over the header for those. text can't
+// be told apart reliably, so we trust the client there
+func blobMimeType(header string, head []byte) string {
+	declared := "application/octet-stream"
+	if mt, _, err := mime.ParseMediaType(header); err == nil && mt != "" {
+		declared = mt
+	}
 
-	return e.JSON(200, resp)
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if sniffed == "" || sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/") {
+		return declared
+	}
+
+	return sniffed
 }
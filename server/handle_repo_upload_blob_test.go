@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/models"
+	"github.com/labstack/echo/v4"
+)
+
+func TestUploadBlobQuotaConcurrent(t *testing.T) {
+	const (
+		quota   = 1000
+		size    = 300
+		uploads = 10
+	)
+
+	s := newTestServer(t)
+	s.blobLimits.quota = quota
+	urepo := createTestRepo(t, s, "did:plc:test")
+
+	e := echo.New()
+
+	// every upload fits in the quota on its own, but only some of them fit together
+	var wg sync.WaitGroup
+	codes := make(chan int, uploads)
+	for i := range uploads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body := bytes.Repeat([]byte{byte(i)}, size)
+			req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.repo.uploadBlob", bytes.NewReader(body))
+			req.Header.Set("content-type", "application/octet-stream")
+			rec := httptest.NewRecorder()
+
+			c := e.NewContext(req, rec)
+			c.Set("repo", &models.RepoActor{Repo: urepo})
+
+			if err := s.handleRepoUploadBlob(c); err != nil {
+				t.Error(err)
+				return
+			}
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	var ok int
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+
+	if ok != quota/size {
+		t.Errorf("expected %d uploads to fit in the quota, got %d", quota/size, ok)
+	}
+
+	used, _, err := s.blobStorageUsed(context.Background(), urepo.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used > quota {
+		t.Errorf("used %d bytes of a %d byte quota", used, quota)
+	}
+}
+
+func TestUploadBlobQuotaBackfillsSizes(t *testing.T) {
+	const (
+		quota = 1000
+		size  = 900
+	)
+
+	s := newTestServer(t)
+	s.blobLimits.quota = quota
+	urepo := createTestRepo(t, s, "did:plc:test")
+
+	ctx := context.Background()
+
+	// a blob that was uploaded before sizes were stored
+	blob := models.Blob{
+		Did:       urepo.Did,
+		CreatedAt: s.repoman.clock.Next().String(),
+		Storage:   blobstore.StorageSqlite,
+	}
+	if err := s.db.Create(ctx, &blob, nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	c, _, err := s.blobstores[blob.Storage].Put(ctx, &blob, bytes.NewReader(make([]byte, size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Exec(ctx, "UPDATE blobs SET cid = ?, size = 0 WHERE id = ?", nil, c.Bytes(), blob.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// the quota can't be checked against a size we don't know yet
+	limit, err := s.blobUploadLimit(ctx, &urepo, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.quota {
+		t.Errorf("expected the quota not to be enforced before sizes are backfilled, got a limit of %d", limit.size)
+	}
+
+	s.backfillBlobSizes(ctx)
+
+	used, known, err := s.blobStorageUsed(ctx, urepo.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != size || !known {
+		t.Errorf("expected %d bytes used after backfilling, got %d (known: %v)", size, used, known)
+	}
+
+	limit, err = s.blobUploadLimit(ctx, &urepo, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limit.quota || limit.size != quota-size {
+		t.Errorf("expected the quota to limit uploads to %d bytes, got %d (quota: %v)", quota-size, limit.size, limit.quota)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/internal/helpers"
+	"github.com/haileyok/cocoon/repo_verifier"
+	"github.com/labstack/echo/v4"
+)
+
+// handleRepoVerify checks a repo for consistency and returns a report of any problems it found
+func (s *Server) handleRepoVerify(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	did, err := syntax.ParseDID(e.QueryParam("did"))
+	if err != nil {
+		return helpers.InputError(e, to.StringPtr("a valid did must be supplied"))
+	}
+
+	// writes would make the records table and the mst look like they disagree partway through
+	unlock := s.repoman.lockRepo(did.String())
+	defer unlock()
+
+	report, err := repo_verifier.Verify(ctx, s.db, did.String(), s.resolveSigningKey)
+	if errors.Is(err, repo_verifier.ErrRepoNotFound) {
+		return helpers.InputError(e, to.StringPtr("RepoNotFound"))
+	}
+	if err != nil {
+		s.logger.Error("error verifying repo", "did", did, "error", err)
+		return helpers.ServerError(e, nil)
+	}
+
+	return e.JSON(200, report)
+}
+
+func (s *Server) resolveSigningKey(ctx context.Context, did string) (atcrypto.PublicKey, error) {
+	// the key may have just been rotated, so don't trust the cache
+	doc, err := s.passport.FetchDoc(context.WithValue(ctx, "skip-cache", true), did)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc.SigningKey()
+}
@@ -38,7 +38,6 @@ func (s *Server) handleServerActivateAccount(e echo.Context) error {
 			Active: true,
 			Did:    urepo.Repo.Did,
 			Status: nil,
-			Seq:    time.Now().UnixMicro(), // TODO: bad puppy
 			Time:   time.Now().Format(util.ISO8601),
 		},
 	})
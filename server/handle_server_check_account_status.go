@@ -17,6 +17,10 @@ type ComAtprotoServerCheckAccountStatusResponse struct {
 	PrivateStateValues int64  `json:"privateStateValues"`
 	ExpectedBlobs      int64  `json:"expectedBlobs"`
 	ImportedBlobs      int64  `json:"importedBlobs"`
+
+	// not part of the lexicon, but handy for seeing how close an account is to its quota
+	BlobStorageUsed  int64  `json:"blobStorageUsed"`
+	BlobStorageQuota *int64 `json:"blobStorageQuota,omitempty"`
 }
 
 func (s *Server) handleServerCheckAccountStatus(e echo.Context) error {
@@ -63,5 +67,16 @@ func (s *Server) handleServerCheckAccountStatus(e echo.Context) error {
 	}
 	resp.ExpectedBlobs = blobCtResp.Ct
 
+	used, _, err := s.blobStorageUsed(ctx, urepo.Repo.Did)
+	if err != nil {
+		s.logger.Error("error getting blob storage used", "error", err)
+		return helpers.ServerError(e, nil)
+	}
+	resp.BlobStorageUsed = used
+
+	if quota := s.blobQuota(&urepo.Repo); quota > 0 {
+		resp.BlobStorageQuota = &quota
+	}
+
 	return e.JSON(200, resp)
 }
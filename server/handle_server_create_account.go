@@ -13,8 +13,11 @@ import (
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/haileyok/cocoon/internal/db"
 	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/haileyok/cocoon/models"
+	"github.com/haileyok/cocoon/recording_blockstore"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -218,7 +221,7 @@ func (s *Server) handleCreateAccount(e echo.Context) error {
 	}
 
 	if request.Did == nil || *request.Did == "" {
-		bs := s.getBlockstore(signupDid)
+		bs := recording_blockstore.New(s.getReadOnlyBlockstore(signupDid))
 		r := repo.NewRepo(context.TODO(), signupDid, bs)
 
 		root, rev, err := r.Commit(context.TODO(), urepo.SignFor)
@@ -227,7 +230,18 @@ func (s *Server) handleCreateAccount(e echo.Context) error {
 			return helpers.ServerError(e, nil)
 		}
 
-		if err := s.UpdateRepo(context.TODO(), urepo.Did, root, rev); err != nil {
+		if err := s.db.Transaction(context.TODO(), func(tx *db.DB) error {
+			newblocks := make([]blocks.Block, 0, len(bs.GetWriteLog()))
+			for _, blk := range bs.GetWriteLog() {
+				newblocks = append(newblocks, blk)
+			}
+
+			if err := s.getTxBlockstore(tx, signupDid, rev).PutMany(context.TODO(), newblocks); err != nil {
+				return err
+			}
+
+			return s.UpdateRepo(context.TODO(), tx, urepo.Did, root, rev)
+		}); err != nil {
 			s.logger.Error("error updating repo after commit", "error", err)
 			return helpers.ServerError(e, nil)
 		}
@@ -236,7 +250,6 @@ func (s *Server) handleCreateAccount(e echo.Context) error {
 			RepoIdentity: &atproto.SyncSubscribeRepos_Identity{
 				Did:    urepo.Did,
 				Handle: to.StringPtr(request.Handle),
-				Seq:    time.Now().UnixMicro(), // TODO: no
 				Time:   time.Now().Format(util.ISO8601),
 			},
 		})
@@ -39,7 +39,6 @@ func (s *Server) handleServerDeactivateAccount(e echo.Context) error {
 			Active: false,
 			Did:    urepo.Repo.Did,
 			Status: to.StringPtr("deactivated"),
-			Seq:    time.Now().UnixMicro(), // TODO: bad puppy
 			Time:   time.Now().Format(util.ISO8601),
 		},
 	})
@@ -2,13 +2,16 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/util"
+	"github.com/haileyok/cocoon/internal/db"
 	"github.com/haileyok/cocoon/internal/helpers"
+	"github.com/haileyok/cocoon/models"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -68,80 +71,73 @@ func (s *Server) handleServerDeleteAccount(e echo.Context) error {
 		})
 	}
 
-	tx := s.db.BeginDangerously(ctx)
-	if tx.Error != nil {
-		s.logger.Error("error starting transaction", "error", tx.Error)
-		return helpers.ServerError(e, nil)
+	// everything for the account is removed in a single transaction, so a failure halfway through doesn't leave us with
+	// a repo that has no blocks or an actor without a repo
+	evt := &events.XRPCStreamEvent{
+		RepoAccount: &atproto.SyncSubscribeRepos_Account{
+			Active: false,
+			Did:    req.Did,
+			Status: to.StringPtr("deleted"),
+			Time:   time.Now().Format(util.ISO8601),
+		},
 	}
 
-	if err := tx.Exec("DELETE FROM blocks WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting blocks", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+	var blobs []models.Blob
+	if err := s.db.Transaction(ctx, func(tx *db.DB) error {
+		// grab the blobs before deleting their rows, so their data can be removed from the blobstore afterwards
+		if err := tx.Raw(ctx, "SELECT * FROM blobs WHERE did = ?", nil, req.Did).Scan(&blobs).Error; err != nil {
+			return fmt.Errorf("error getting blobs: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM records WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting records", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM blocks WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting blocks: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM blobs WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting blobs", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM records WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting records: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM tokens WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting tokens", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM blobs WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting blobs: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM refresh_tokens WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting refresh tokens", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM tokens WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting tokens: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM reserved_keys WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting reserved keys", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM refresh_tokens WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting refresh tokens: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM invite_codes WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting invite codes", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM reserved_keys WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting reserved keys: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM actors WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting actor", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM invite_codes WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting invite codes: %w", err)
+		}
 
-	if err := tx.Exec("DELETE FROM repos WHERE did = ?", nil, req.Did).Error; err != nil {
-		tx.Rollback()
-		s.logger.Error("error deleting repo", "error", err)
-		return helpers.ServerError(e, nil)
-	}
+		if err := tx.Exec(ctx, "DELETE FROM actors WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting actor: %w", err)
+		}
+
+		if err := tx.Exec(ctx, "DELETE FROM repos WHERE did = ?", nil, req.Did).Error; err != nil {
+			return fmt.Errorf("error deleting repo: %w", err)
+		}
 
-	if err := tx.Commit().Error; err != nil {
-		s.logger.Error("error committing transaction", "error", err)
+		return s.evtpersister.PersistTx(ctx, tx, evt)
+	}); err != nil {
+		s.logger.Error("error deleting account", "error", err)
 		return helpers.ServerError(e, nil)
 	}
 
-	s.evtman.AddEvent(context.TODO(), &events.XRPCStreamEvent{
-		RepoAccount: &atproto.SyncSubscribeRepos_Account{
-			Active: false,
-			Did:    req.Did,
-			Status: to.StringPtr("deleted"),
-			Seq:    time.Now().UnixMicro(),
-			Time:   time.Now().Format(util.ISO8601),
-		},
-	})
+	// removing the data can take a while if s3 needs a few retries, so don't hold up the response
+	go s.deleteBlobData(context.Background(), blobs)
+
+	// the account event only goes out once the deletion has been committed
+	if err := s.evtpersister.Broadcast(ctx, evt); err != nil {
+		s.logger.Error("error broadcasting account event", "did", req.Did, "error", err)
+	}
 
 	return e.NoContent(200)
 }
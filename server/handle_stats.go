@@ -0,0 +1,22 @@
+package server
+
+import (
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	"github.com/labstack/echo/v4"
+)
+
+type StatsResponse struct {
+	// BlockCache is nil when the block cache is disabled
+	BlockCache *sqlite_blockstore.BlockCacheStats `json:"blockCache"`
+}
+
+func (s *Server) handleStats(e echo.Context) error {
+	var resp StatsResponse
+
+	if s.blockCache != nil {
+		stats := s.blockCache.Stats()
+		resp.BlockCache = &stats
+	}
+
+	return e.JSON(200, resp)
+}
@@ -1,15 +1,14 @@
 package server
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/Azure/go-autorest/autorest/to"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/haileyok/cocoon/blobstore"
 	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/haileyok/cocoon/models"
 	"github.com/ipfs/go-cid"
@@ -53,83 +52,160 @@ func (s *Server) handleSyncGetBlob(e echo.Context) error {
 		return helpers.ServerError(e, nil)
 	}
 
-	buf := new(bytes.Buffer)
+	if blob.ID == 0 {
+		return helpers.InputError(e, to.StringPtr("BlobNotFound"))
+	}
 
-	if blob.Storage == "sqlite" {
-		var parts []models.BlobPart
-		if err := s.db.Raw(ctx, "SELECT * FROM blob_parts WHERE blob_id = ? ORDER BY idx", nil, blob.ID).Scan(&parts).Error; err != nil {
-			s.logger.Error("error getting blob parts", "error", err)
-			return helpers.ServerError(e, nil)
-		}
+	bs, ok := s.blobstores[blob.Storage]
+	if !ok {
+		s.logger.Error("blob is in a storage that isn't enabled", "storage", blob.Storage)
+		return helpers.ServerError(e, nil)
+	}
 
-		// TODO: we can just stream this, don't need to make a buffer
-		for _, p := range parts {
-			buf.Write(p.Data)
-		}
-	} else if blob.Storage == "s3" {
-		if !(s.s3Config != nil && s.s3Config.BlobstoreEnabled) {
-			s.logger.Error("s3 storage disabled")
-			return helpers.ServerError(e, nil)
-		}
+	if blob.Storage == blobstore.StorageS3 && s.s3Config.CDNUrl != "" {
+		redirectUrl := fmt.Sprintf("%s/%s", s.s3Config.CDNUrl, blobstore.S3Key(urepo.Repo.Did, c))
+		return e.Redirect(302, redirectUrl)
+	}
 
-		blobKey := fmt.Sprintf("blobs/%s/%s", urepo.Repo.Did, c.String())
+	h := e.Response().Header()
 
-		if s.s3Config.CDNUrl != "" {
-			redirectUrl := fmt.Sprintf("%s/%s", s.s3Config.CDNUrl, blobKey)
-			return e.Redirect(302, redirectUrl)
-		}
+	// blobs are content addressed, so the cid makes a perfect etag and the response can be cached forever
+	etag := `"` + c.String() + `"`
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
 
-		config := &aws.Config{
-			Region:      aws.String(s.s3Config.Region),
-			Credentials: credentials.NewStaticCredentials(s.s3Config.AccessKey, s.s3Config.SecretKey, ""),
-		}
+	// blobs are user content. never let the browser guess at the type or run anything that comes back
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
 
-		if s.s3Config.Endpoint != "" {
-			config.Endpoint = aws.String(s.s3Config.Endpoint)
-			config.S3ForcePathStyle = aws.Bool(true)
-		}
+	if etagMatches(e.Request().Header.Get("If-None-Match"), etag) {
+		return e.NoContent(304)
+	}
+
+	mimeType := blob.MimeType
+	size := blob.Size
+	if mimeType == "" {
+		// blobs uploaded before we kept track of the type or size. these are only ever served as a download
+		mimeType = "application/octet-stream"
 
-		sess, err := session.NewSession(config)
+		info, err := bs.Stat(ctx, &blob)
 		if err != nil {
-			s.logger.Error("error creating aws session", "error", err)
+			if errors.Is(err, blobstore.ErrNotFound) {
+				return helpers.InputError(e, to.StringPtr("BlobNotFound"))
+			}
+			s.logger.Error("error getting blob size", "storage", blob.Storage, "error", err)
 			return helpers.ServerError(e, nil)
 		}
+		size = info.Size
 
-		svc := s3.New(sess)
-		if result, err := svc.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(s.s3Config.Bucket),
-			Key:    aws.String(blobKey),
-		}); err != nil {
-			s.logger.Error("error getting blob from s3", "error", err)
-			return helpers.ServerError(e, nil)
-		} else {
-			read := 0
-			part := 0
-			partBuf := make([]byte, 0x10000)
-
-			for {
-				n, err := io.ReadFull(result.Body, partBuf)
-				if err == io.ErrUnexpectedEOF || err == io.EOF {
-					if n == 0 {
-						break
-					}
-				} else if err != nil && err != io.ErrUnexpectedEOF {
-					s.logger.Error("error reading blob", "error", err)
-					return helpers.ServerError(e, nil)
-				}
-
-				data := partBuf[:n]
-				read += n
-				buf.Write(data)
-				part++
+		h.Set(echo.HeaderContentDisposition, "attachment; filename="+c.String())
+	}
+
+	h.Set("Accept-Ranges", "bytes")
+
+	// a range is only honored if the client's copy is still the same blob, which for a cid is always the case as long
+	// as the etag matches
+	var rng *blobRange
+	if rh := e.Request().Header.Get("Range"); rh != "" {
+		if ir := e.Request().Header.Get("If-Range"); ir == "" || ir == etag {
+			r, err := parseBlobRange(rh, size)
+			if errors.Is(err, errRangeNotSatisfiable) {
+				h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				return e.NoContent(416)
+			}
+			// anything we can't parse (or multiple ranges) just gets the whole blob, which is always allowed
+			if err == nil {
+				rng = r
 			}
 		}
+	}
+
+	var rc io.ReadCloser
+	code := 200
+	if rng != nil {
+		rc, err = bs.GetRange(ctx, &blob, rng.start, rng.length)
+		code = 206
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size))
+		h.Set(echo.HeaderContentLength, strconv.FormatInt(rng.length, 10))
 	} else {
-		s.logger.Error("unknown storage", "storage", blob.Storage)
+		rc, err = bs.Get(ctx, &blob)
+		h.Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+	}
+	if err != nil {
+		// the headers haven't been written yet, so these still go out as a normal error response
+		h.Del("Content-Range")
+		h.Del(echo.HeaderContentLength)
+		if errors.Is(err, blobstore.ErrNotFound) {
+			return helpers.InputError(e, to.StringPtr("BlobNotFound"))
+		}
+		s.logger.Error("error getting blob", "storage", blob.Storage, "error", err)
 		return helpers.ServerError(e, nil)
 	}
+	defer rc.Close()
 
-	e.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename="+c.String())
+	return e.Stream(code, mimeType, rc)
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+type blobRange struct {
+	start  int64
+	length int64
+}
+
+// parseBlobRange parses a Range header for a blob of the given size. only a single range is supported
+func parseBlobRange(header string, size int64) (*blobRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, fmt.Errorf("unsupported range %q", header)
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid range %q", header)
+	}
+
+	// a suffix range like bytes=-500 asks for the last 500 bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid range %q", header)
+		}
+		if n == 0 || size == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return &blobRange{start: size - n, length: n}, nil
+	}
 
-	return e.Stream(200, "application/octet-stream", buf)
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid range %q", header)
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid range %q", header)
+		}
+		end = min(end, size-1)
+	}
+
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+
+	return &blobRange{start: start, length: end - start + 1}, nil
+}
+
+// etagMatches checks an If-None-Match header against an etag
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
 }
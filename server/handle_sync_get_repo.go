@@ -2,8 +2,14 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
 	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/haileyok/cocoon/models"
 	"github.com/ipfs/go-cid"
@@ -12,6 +18,10 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	getRepoBatchSize = 500
+)
+
 func (s *Server) handleSyncGetRepo(e echo.Context) error {
 	ctx := e.Request().Context()
 
@@ -20,6 +30,16 @@ func (s *Server) handleSyncGetRepo(e echo.Context) error {
 		return helpers.InputError(e, nil)
 	}
 
+	// if a since rev is supplied, we only send the blocks that were written by commits after it
+	var since string
+	if sinceStr := e.QueryParam("since"); sinceStr != "" {
+		tid, err := syntax.ParseTID(sinceStr)
+		if err != nil {
+			return helpers.InputError(e, nil)
+		}
+		since = tid.String()
+	}
+
 	urepo, err := s.getRepoActorByDid(ctx, did)
 	if err != nil {
 		return err
@@ -34,24 +54,123 @@ func (s *Server) handleSyncGetRepo(e echo.Context) error {
 		Roots:   []cid.Cid{rc},
 		Version: 1,
 	})
+	if err != nil {
+		s.logger.Error("error creating car header", "error", err)
+		return helpers.ServerError(e, nil)
+	}
 
-	buf := new(bytes.Buffer)
+	e.Response().Header().Set(echo.HeaderContentType, "application/vnd.ipld.car")
+	e.Response().WriteHeader(200)
 
-	if _, err := carstore.LdWrite(buf, hb); err != nil {
+	if _, err := carstore.LdWrite(e.Response(), hb); err != nil {
 		s.logger.Error("error writing to car", "error", err)
-		return helpers.ServerError(e, nil)
+		return nil
 	}
 
-	var blocks []models.Block
-	if err := s.db.Raw(ctx, "SELECT * FROM blocks WHERE did = ? ORDER BY rev ASC", nil, urepo.Repo.Did).Scan(&blocks).Error; err != nil {
-		return err
+	// once we've started writing the body there's no way to send an error back, so all we can do is log and stop
+	if err := s.writeRepoBlocks(ctx, e.Response(), urepo.Repo.Did, rc, since); err != nil {
+		s.logger.Error("error writing repo blocks", "did", urepo.Repo.Did, "error", err)
 	}
 
-	for _, block := range blocks {
-		if _, err := carstore.LdWrite(buf, block.Cid, block.Value); err != nil {
+	return nil
+}
+
+type repoBlockKind int
+
+const (
+	repoBlockKindCommit repoBlockKind = iota
+	repoBlockKindNode
+	repoBlockKindRecord
+)
+
+type repoBlockRef struct {
+	cid  cid.Cid
+	kind repoBlockKind
+}
+
+// writeRepoBlocks walks the repo from its commit and writes every reachable block to w as it goes. blocks are fetched
+// breadth first in batches, so we never hold much more than a batch of blocks in memory. if since is set, any block
+// with a rev at or before it is skipped along with everything below it. blocks get tagged with the rev of the last
+// commit that wrote them, and every block that a commit adds back to the tree gets written again, so a block with an
+// older rev has been part of the repo since then and the client already has it and everything below it
+func (s *Server) writeRepoBlocks(ctx context.Context, w io.Writer, did string, root cid.Cid, since string) error {
+	flusher, _ := w.(interface{ Flush() })
+
+	seen := map[cid.Cid]struct{}{root: {}}
+	queue := []repoBlockRef{{cid: root, kind: repoBlockKindCommit}}
+
+	for len(queue) > 0 {
+		n := min(len(queue), getRepoBatchSize)
+		batch := queue[:n]
+		queue = queue[n:]
+
+		cids := make([][]byte, 0, len(batch))
+		for _, ref := range batch {
+			cids = append(cids, ref.cid.Bytes())
+		}
+
+		var rows []models.Block
+		if err := s.db.Raw(ctx, "SELECT * FROM blocks WHERE did = ? AND cid IN ?", nil, did, cids).Scan(&rows).Error; err != nil {
 			return err
 		}
+
+		found := make(map[string]models.Block, len(rows))
+		for _, row := range rows {
+			found[string(row.Cid)] = row
+		}
+
+		for _, ref := range batch {
+			blk, ok := found[string(ref.cid.Bytes())]
+			if !ok {
+				return fmt.Errorf("block %s is missing from the blockstore", ref.cid)
+			}
+
+			if since != "" && blk.Rev <= since {
+				continue
+			}
+
+			if _, err := carstore.LdWrite(w, blk.Cid, blk.Value); err != nil {
+				return err
+			}
+
+			var next []repoBlockRef
+			switch ref.kind {
+			case repoBlockKindCommit:
+				var sc repo.SignedCommit
+				if err := sc.UnmarshalCBOR(bytes.NewReader(blk.Value)); err != nil {
+					return fmt.Errorf("error decoding commit %s: %w", ref.cid, err)
+				}
+				next = append(next, repoBlockRef{cid: sc.Data, kind: repoBlockKindNode})
+			case repoBlockKindNode:
+				var nd mst.NodeData
+				if err := nd.UnmarshalCBOR(bytes.NewReader(blk.Value)); err != nil {
+					return fmt.Errorf("error decoding mst node %s: %w", ref.cid, err)
+				}
+				if nd.Left != nil {
+					next = append(next, repoBlockRef{cid: *nd.Left, kind: repoBlockKindNode})
+				}
+				for _, e := range nd.Entries {
+					next = append(next, repoBlockRef{cid: e.Val, kind: repoBlockKindRecord})
+					if e.Tree != nil {
+						next = append(next, repoBlockRef{cid: *e.Tree, kind: repoBlockKindNode})
+					}
+				}
+			}
+
+			// the same record can show up under more than one key, but it only needs to be in the car once
+			for _, ref := range next {
+				if _, ok := seen[ref.cid]; ok {
+					continue
+				}
+				seen[ref.cid] = struct{}{}
+				queue = append(queue, ref)
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
 	}
 
-	return e.Stream(200, "application/vnd.ipld.car", bytes.NewReader(buf.Bytes()))
+	return nil
 }
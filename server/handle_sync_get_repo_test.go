@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/haileyok/cocoon/internal/repowalk"
+	"github.com/haileyok/cocoon/models"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+)
+
+func currentRepo(t *testing.T, s *Server, did string) (cid.Cid, string) {
+	t.Helper()
+
+	var current models.Repo
+	if err := s.db.Raw(context.Background(), "SELECT * FROM repos WHERE did = ?", nil, did).Scan(&current).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := cid.Cast(current.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root, current.Rev
+}
+
+// getRepoBlocks writes the repo the same way getRepo does and loads the resulting car into bs
+func getRepoBlocks(t *testing.T, s *Server, did string, root cid.Cid, since string, bs blockstore.Blockstore) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	hb, err := cbor.DumpObject(&car.CarHeader{
+		Roots:   []cid.Cid{root},
+		Version: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := carstore.LdWrite(buf, hb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.writeRepoBlocks(ctx, buf, did, root, since); err != nil {
+		t.Fatal(err)
+	}
+
+	cr, err := car.NewCarReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err != nil {
+			break
+		}
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetRepoSinceRecreatedRecords(t *testing.T) {
+	s := newTestServer(t)
+	urepo := createTestRepo(t, s, "did:plc:test")
+
+	ctx := context.Background()
+
+	deletePost := func(rkey string) Op {
+		return Op{Type: OpTypeDelete, Collection: "app.bsky.feed.post", Rkey: &rkey}
+	}
+
+	steps := []struct {
+		name   string
+		writes []Op
+	}{
+		{"create", []Op{testPost("a"), testPost("b"), testPost("c"), testPost("d")}},
+		{"delete", []Op{deletePost("c")}},
+		{"recreate", []Op{testPost("c")}},
+		{"delete all", []Op{deletePost("a"), deletePost("b"), deletePost("c"), deletePost("d")}},
+		{"recreate all", []Op{testPost("a"), testPost("b"), testPost("c"), testPost("d")}},
+	}
+
+	// a client that keeps up with getRepo?since= only holds on to the blocks of the rev that it's at. whatever it has plus
+	// the blocks since that rev has to make up the whole repo again
+	root, rev := currentRepo(t, s, urepo.Did)
+	client := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	getRepoBlocks(t, s, urepo.Did, root, "", client)
+
+	for _, step := range steps {
+		if _, err := s.repoman.applyWrites(ctx, urepo, step.writes, nil); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		since := rev
+		root, rev = currentRepo(t, s, urepo.Did)
+		getRepoBlocks(t, s, urepo.Did, root, since, client)
+
+		// drop everything that isn't part of the new rev, like the client would
+		next := blockstore.NewBlockstore(datastore.NewMapDatastore())
+		if err := repowalk.Walk(ctx, client, root, nil, func(blk blocks.Block) error {
+			return next.Put(ctx, blk)
+		}); err != nil {
+			t.Fatalf("%s: repo is incomplete after getRepo since %s: %v", step.name, since, err)
+		}
+		client = next
+	}
+
+	// rederiving the revs has to come up with the same ones that the blocks were tagged with when they were written
+	var written []models.Block
+	if err := s.db.Raw(ctx, "SELECT cid, rev FROM blocks WHERE did = ?", nil, urepo.Did).Scan(&written).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.db.Exec(ctx, "UPDATE blocks SET rev = ? WHERE did = ?", nil, "", urepo.Did).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := sqlite_blockstore.BackfillRevs(ctx, s.db, urepo.Did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Orphans != 0 {
+		t.Errorf("expected no orphaned blocks, found %d", res.Orphans)
+	}
+
+	for _, blk := range written {
+		var rev string
+		if err := s.db.Raw(ctx, "SELECT rev FROM blocks WHERE did = ? AND cid = ?", nil, urepo.Did, blk.Cid).Scan(&rev).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if rev != blk.Rev {
+			c, _ := cid.Cast(blk.Cid)
+			t.Errorf("block %s was written at %s but backfilled as %s", c, blk.Rev, rev)
+		}
+	}
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"strconv"
 	"time"
 
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/events"
 	"github.com/bluesky-social/indigo/lex/util"
 	"github.com/btcsuite/websocket"
+	"github.com/haileyok/cocoon/internal/helpers"
 	"github.com/labstack/echo/v4"
 )
 
@@ -14,6 +18,15 @@ func (s *Server) handleSyncSubscribeRepos(e echo.Context) error {
 	ctx := e.Request().Context()
 	logger := s.logger.With("component", "subscribe-repos-websocket")
 
+	var since *int64
+	if cursorStr := e.QueryParam("cursor"); cursorStr != "" {
+		cursor, err := strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil || cursor < 0 {
+			return helpers.InputError(e, nil)
+		}
+		since = &cursor
+	}
+
 	conn, err := websocket.Upgrade(e.Response().Writer, e.Request(), e.Response().Header(), 1<<10, 1<<10)
 	if err != nil {
 		logger.Error("unable to establish websocket with relay", "err", err)
@@ -22,63 +35,62 @@ func (s *Server) handleSyncSubscribeRepos(e echo.Context) error {
 
 	ident := e.RealIP() + "-" + e.Request().UserAgent()
 	logger = logger.With("ident", ident)
-	logger.Info("new connection established")
+	logger.Info("new connection established", "cursor", since)
+
+	if since != nil {
+		if *since > s.evtpersister.CurrentSeq() {
+			// the spec says that we should send an error and close the connection if the cursor is in the future
+			if err := s.writeSubscribeReposEvent(conn, &events.XRPCStreamEvent{
+				Error: &events.ErrorFrame{
+					Error:   "FutureCursor",
+					Message: "Cursor in the future.",
+				},
+			}); err != nil {
+				logger.Error("failed to write future cursor error to relay", "err", err)
+			}
+			conn.Close()
+			return nil
+		}
+
+		oldest, err := s.evtpersister.OldestSeq(ctx)
+		if err != nil {
+			logger.Error("error getting oldest event seq", "err", err)
+			conn.Close()
+			return nil
+		}
+
+		// if the cursor is older than anything we still have around, let the consumer know that they might be missing
+		// some events. we'll still play back everything that we do have
+		if oldest > 0 && *since < oldest-1 {
+			if err := s.writeSubscribeReposEvent(conn, &events.XRPCStreamEvent{
+				RepoInfo: &atproto.SyncSubscribeRepos_Info{
+					Name:    "OutdatedCursor",
+					Message: to.StringPtr("Requested cursor exceeded limit. Possibly missing events"),
+				},
+			}); err != nil {
+				logger.Error("failed to write outdated cursor info to relay", "err", err)
+				conn.Close()
+				return nil
+			}
+		}
+	}
 
 	evts, cancel, err := s.evtman.Subscribe(ctx, ident, func(evt *events.XRPCStreamEvent) bool {
 		return true
-	}, nil)
+	}, since)
 	if err != nil {
 		return err
 	}
 	defer cancel()
 
-	header := events.EventHeader{Op: events.EvtKindMessage}
 	for evt := range evts {
-		wc, err := conn.NextWriter(websocket.BinaryMessage)
-		if err != nil {
-			logger.Error("error writing message to relay", "err", err)
-			break
-		}
-
 		if ctx.Err() != nil {
-			logger.Error("context error", "err", err)
+			logger.Error("context error", "err", ctx.Err())
 			break
 		}
 
-		var obj util.CBOR
-		switch {
-		case evt.Error != nil:
-			header.Op = events.EvtKindErrorFrame
-			obj = evt.Error
-		case evt.RepoCommit != nil:
-			header.MsgType = "#commit"
-			obj = evt.RepoCommit
-		case evt.RepoIdentity != nil:
-			header.MsgType = "#identity"
-			obj = evt.RepoIdentity
-		case evt.RepoAccount != nil:
-			header.MsgType = "#account"
-			obj = evt.RepoAccount
-		case evt.RepoInfo != nil:
-			header.MsgType = "#info"
-			obj = evt.RepoInfo
-		default:
-			logger.Warn("unrecognized event kind")
-			return nil
-		}
-
-		if err := header.MarshalCBOR(wc); err != nil {
-			logger.Error("failed to write header to relay", "err", err)
-			break
-		}
-
-		if err := obj.MarshalCBOR(wc); err != nil {
-			logger.Error("failed to write event to relay", "err", err)
-			break
-		}
-
-		if err := wc.Close(); err != nil {
-			logger.Error("failed to flush-close our event write", "err", err)
+		if err := s.writeSubscribeReposEvent(conn, evt); err != nil {
+			logger.Error("error writing event to relay", "err", err)
 			break
 		}
 	}
@@ -93,3 +105,47 @@ func (s *Server) handleSyncSubscribeRepos(e echo.Context) error {
 
 	return nil
 }
+
+func (s *Server) writeSubscribeReposEvent(conn *websocket.Conn, evt *events.XRPCStreamEvent) error {
+	header := events.EventHeader{Op: events.EvtKindMessage}
+
+	var obj util.CBOR
+	switch {
+	case evt.Error != nil:
+		header.Op = events.EvtKindErrorFrame
+		obj = evt.Error
+	case evt.RepoCommit != nil:
+		header.MsgType = "#commit"
+		obj = evt.RepoCommit
+	case evt.RepoSync != nil:
+		header.MsgType = "#sync"
+		obj = evt.RepoSync
+	case evt.RepoIdentity != nil:
+		header.MsgType = "#identity"
+		obj = evt.RepoIdentity
+	case evt.RepoAccount != nil:
+		header.MsgType = "#account"
+		obj = evt.RepoAccount
+	case evt.RepoInfo != nil:
+		header.MsgType = "#info"
+		obj = evt.RepoInfo
+	default:
+		s.logger.Warn("unrecognized event kind")
+		return nil
+	}
+
+	wc, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	if err := header.MarshalCBOR(wc); err != nil {
+		return err
+	}
+
+	if err := obj.MarshalCBOR(wc); err != nil {
+		return err
+	}
+
+	return wc.Close()
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"gorm.io/gorm/clause"
+)
+
+// importBlockstore reads and writes the staged blocks of a single repo import. nothing is kept in memory, so a repo of
+// any size can be checked before it gets swapped in
+type importBlockstore struct {
+	db *db.DB
+	id string
+}
+
+func newImportBlockstore(db *db.DB, id string) *importBlockstore {
+	return &importBlockstore{
+		db: db,
+		id: id,
+	}
+}
+
+func (bs *importBlockstore) Get(ctx context.Context, cid cid.Cid) (blocks.Block, error) {
+	var block models.ImportBlock
+	res := bs.db.Raw(ctx, "SELECT * FROM import_blocks WHERE import_id = ? AND cid = ?", nil, bs.id, cid.Bytes()).Scan(&block)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ipld.ErrNotFound{Cid: cid}
+	}
+
+	return blocks.NewBlockWithCid(block.Value, cid)
+}
+
+func (bs *importBlockstore) Put(ctx context.Context, block blocks.Block) error {
+	return bs.PutMany(ctx, []blocks.Block{block})
+}
+
+// PutMany writes blocks with a single insert. a car is allowed to have the same block more than once, so blocks that
+// are already staged are skipped
+func (bs *importBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if len(blks) == 0 {
+		return nil
+	}
+
+	rows := make([]models.ImportBlock, 0, len(blks))
+	for _, block := range blks {
+		rows = append(rows, models.ImportBlock{
+			ImportID: bs.id,
+			Cid:      block.Cid().Bytes(),
+			Value:    block.RawData(),
+		})
+	}
+
+	return bs.db.Create(ctx, &rows, []clause.Expression{clause.OnConflict{DoNothing: true}}).Error
+}
+
+func (bs *importBlockstore) DeleteBlock(ctx context.Context, cid cid.Cid) error {
+	return bs.db.Exec(ctx, "DELETE FROM import_blocks WHERE import_id = ? AND cid = ?", nil, bs.id, cid.Bytes()).Error
+}
+
+func (bs *importBlockstore) Has(ctx context.Context, cid cid.Cid) (bool, error) {
+	var count int64
+	if err := bs.db.Raw(ctx, "SELECT COUNT(*) FROM import_blocks WHERE import_id = ? AND cid = ?", nil, bs.id, cid.Bytes()).Scan(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (bs *importBlockstore) GetSize(ctx context.Context, cid cid.Cid) (int, error) {
+	var sizes []int
+	if err := bs.db.Raw(ctx, "SELECT LENGTH(value) FROM import_blocks WHERE import_id = ? AND cid = ?", nil, bs.id, cid.Bytes()).Scan(&sizes).Error; err != nil {
+		return 0, err
+	}
+
+	if len(sizes) == 0 {
+		return 0, ipld.ErrNotFound{Cid: cid}
+	}
+
+	return sizes[0], nil
+}
+
+func (bs *importBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return nil, errors.New("not supported for repo imports")
+}
+
+// HashOnRead is a no-op. the car reader already checks every block against its cid before it gets staged
+func (bs *importBlockstore) HashOnRead(enabled bool) {
+}
+
+// clear removes everything that was staged for the import
+func (bs *importBlockstore) clear(ctx context.Context) error {
+	return bs.db.Exec(ctx, "DELETE FROM import_blocks WHERE import_id = ?", nil, bs.id).Error
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -15,7 +16,9 @@ import (
 	"github.com/bluesky-social/indigo/carstore"
 	"github.com/bluesky-social/indigo/events"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/mst"
 	"github.com/bluesky-social/indigo/repo"
+	"github.com/haileyok/cocoon/blobstore"
 	"github.com/haileyok/cocoon/internal/db"
 	"github.com/haileyok/cocoon/models"
 	"github.com/haileyok/cocoon/recording_blockstore"
@@ -30,6 +33,7 @@ type RepoMan struct {
 	db    *db.DB
 	s     *Server
 	clock *syntax.TIDClock
+	locks *repoLocks
 }
 
 func NewRepoMan(s *Server) *RepoMan {
@@ -39,9 +43,15 @@ func NewRepoMan(s *Server) *RepoMan {
 		s:     s,
 		db:    s.db,
 		clock: &clock,
+		locks: newRepoLocks(),
 	}
 }
 
+// lockRepo blocks until we are the only writer for the given repo. the returned func releases the lock
+func (rm *RepoMan) lockRepo(did string) func() {
+	return rm.locks.lock(did)
+}
+
 type OpType string
 
 var (
@@ -59,12 +69,32 @@ type Op struct {
 	Collection string          `json:"collection"`
 	Rkey       *string         `json:"rkey,omitempty"`
 	Validate   *bool           `json:"validate,omitempty"`
-	SwapRecord *string         `json:"swapRecord,omitempty"`
+	SwapRecord NullableString  `json:"swapRecord,omitempty"`
 	Record     *MarshalableMap `json:"record,omitempty"`
 }
 
 type MarshalableMap map[string]any
 
+// NullableString tells a field that was left out apart from one that was explicitly set to null. swapRecord on putRecord
+// needs this, since leaving it out skips the check while null means the record must not exist yet
+type NullableString struct {
+	Set   bool
+	Value *string
+}
+
+func (n *NullableString) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		n.Value = nil
+		return nil
+	}
+	return json.Unmarshal(b, &n.Value)
+}
+
+func (n NullableString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.Value)
+}
+
 type FirehoseOp struct {
 	Cid    cid.Cid
 	Path   string
@@ -95,16 +125,71 @@ type RepoCommit struct {
 	Rev string `json:"rev"`
 }
 
-// TODO make use of swap commit
+// ErrInvalidSwap is returned from applyWrites whenever a swapCommit or swapRecord doesn't match the current state of the
+// repo
+var ErrInvalidSwap = errors.New("invalid swap")
+
+// ErrInvalidRecord is returned from applyWrites whenever a record fails lexicon validation
+var ErrInvalidRecord = errors.New("invalid record")
+
 func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []Op, swapCommit *string) ([]ApplyWriteResult, error) {
-	rootcid, err := cid.Cast(urepo.Root)
+	// writes to the same repo need to happen one at a time. otherwise two writers can build on top of the same root, and
+	// whichever one finishes last orphans the other's commit. writes to other repos can build their commits at the same
+	// time, but the transaction at the end still takes the db's write lock, so they are stored one after another
+	unlock := rm.lockRepo(urepo.Did)
+	defer unlock()
+
+	results, evt, unreferenced, err := rm.applyWritesLocked(ctx, urepo, writes, swapCommit)
 	if err != nil {
 		return nil, err
 	}
 
-	dbs := rm.s.getBlockstore(urepo.Did)
+	// blob data can't be removed inside of the transaction since it might not even live in the database, so clean it up
+	// now that the rows are gone. this happens in the background since deletes might need to be retried
+	if len(unreferenced) > 0 {
+		go rm.s.deleteBlobData(context.Background(), unreferenced)
+	}
+
+	// the event was stored along with the commit, but subscribers only get it now that the commit can't be rolled back
+	if err := rm.s.evtpersister.Broadcast(ctx, evt); err != nil {
+		rm.s.logger.Error("error broadcasting commit event", "did", urepo.Did, "error", err)
+	}
+
+	return results, nil
+}
+
+func (rm *RepoMan) applyWritesLocked(ctx context.Context, urepo models.Repo, writes []Op, swapCommit *string) ([]ApplyWriteResult, *events.XRPCStreamEvent, []models.Blob, error) {
+	// the repo we were handed was loaded at the start of the request, so grab the current root and rev now that we hold
+	// the lock, before we compare against or build on top of them
+	var current struct {
+		Root []byte
+		Rev  string
+	}
+	if err := rm.db.Raw(ctx, "SELECT root, rev FROM repos WHERE did = ?", nil, urepo.Did).Scan(&current).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	urepo.Root = current.Root
+	urepo.Rev = current.Rev
+
+	rootcid, err := cid.Cast(urepo.Root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if swapCommit != nil {
+		swapcid, err := cid.Parse(*swapCommit)
+		if err != nil || !swapcid.Equals(rootcid) {
+			return nil, nil, nil, fmt.Errorf("%w: commit %s does not match current root %s", ErrInvalidSwap, *swapCommit, rootcid)
+		}
+	}
+
+	// new blocks are only kept in memory until we write everything out in a single transaction down below
+	dbs := rm.s.getReadOnlyBlockstore(urepo.Did)
 	bs := recording_blockstore.New(dbs)
 	r, err := repo.OpenRepo(ctx, bs, rootcid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	var results []ApplyWriteResult
 
@@ -112,7 +197,7 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 	for i, op := range writes {
 		// updates or deletes must supply an rkey
 		if op.Type != OpTypeCreate && op.Rkey == nil {
-			return nil, fmt.Errorf("invalid rkey")
+			return nil, nil, nil, fmt.Errorf("invalid rkey")
 		} else if op.Type == OpTypeCreate && op.Rkey != nil {
 			// we should conver this op to an update if the rkey already exists
 			_, _, err := r.GetRecord(ctx, fmt.Sprintf("%s/%s", op.Collection, *op.Rkey))
@@ -128,7 +213,30 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 		// validate the record key is actually valid
 		_, err := syntax.ParseRecordKey(*op.Rkey)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
+		}
+
+		// if a swap record was supplied, the record currently at this path needs to have that exact cid. a null swap
+		// record means that there can't be a record at this path yet
+		if op.SwapRecord.Set {
+			currcid, _, err := r.GetRecordBytes(ctx, fmt.Sprintf("%s/%s", op.Collection, *op.Rkey))
+			if op.SwapRecord.Value == nil {
+				if err == nil {
+					return nil, nil, nil, fmt.Errorf("%w: record %s/%s already exists", ErrInvalidSwap, op.Collection, *op.Rkey)
+				}
+				if !errors.Is(err, mst.ErrNotFound) {
+					return nil, nil, nil, err
+				}
+			} else {
+				swapcid, perr := cid.Parse(*op.SwapRecord.Value)
+				if perr != nil {
+					return nil, nil, nil, fmt.Errorf("%w: invalid swap record cid", ErrInvalidSwap)
+				}
+
+				if err != nil || !currcid.Equals(swapcid) {
+					return nil, nil, nil, fmt.Errorf("%w: record %s/%s does not match swap record %s", ErrInvalidSwap, op.Collection, *op.Rkey, swapcid)
+				}
+			}
 		}
 
 		switch op.Type {
@@ -137,30 +245,35 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 			// first we convert to json bytes
 			b, err := json.Marshal(*op.Record)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			// then we use atdata.UnmarshalJSON to convert it back to a map
 			out, err := atdata.UnmarshalJSON(b)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			// finally we can cast to a MarshalableMap
 			mm := MarshalableMap(out)
 
 			// HACK: if a record doesn't contain a $type, we can manually set it here based on the op's collection
 			// i forget why this is actually necessary?
-			if mm["$type"] == "" {
+			if t, _ := mm["$type"].(string); t == "" {
 				mm["$type"] = op.Collection
 			}
 
+			status, err := rm.validateRecord(op.Collection, mm, op.Validate)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
 			nc, err := r.PutRecord(ctx, fmt.Sprintf("%s/%s", op.Collection, *op.Rkey), &mm)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			d, err := atdata.MarshalCBOR(mm)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			entries = append(entries, models.Record{
@@ -176,13 +289,13 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 				Type:             to.StringPtr(OpTypeCreate.String()),
 				Uri:              to.StringPtr("at://" + urepo.Did + "/" + op.Collection + "/" + *op.Rkey),
 				Cid:              to.StringPtr(nc.String()),
-				ValidationStatus: to.StringPtr("valid"), // TODO: obviously this might not be true atm lol
+				ValidationStatus: to.StringPtr(status),
 			})
 		case OpTypeDelete:
 			// try to find the old record in the database
 			var old models.Record
 			if err := rm.db.Raw(ctx, "SELECT value FROM records WHERE did = ? AND nsid = ? AND rkey = ?", nil, urepo.Did, op.Collection, op.Rkey).Scan(&old).Error; err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			// TODO: this is really confusing, and looking at it i have no idea why i did this. below when we are doing deletes, we
@@ -198,7 +311,7 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 			// delete the record from the repo
 			err := r.DeleteRecord(ctx, fmt.Sprintf("%s/%s", op.Collection, *op.Rkey))
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			// add a result for the delete
@@ -209,22 +322,31 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 			// HACK: same hack as above for type fixes
 			b, err := json.Marshal(*op.Record)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			out, err := atdata.UnmarshalJSON(b)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 			mm := MarshalableMap(out)
 
+			if t, _ := mm["$type"].(string); t == "" {
+				mm["$type"] = op.Collection
+			}
+
+			status, err := rm.validateRecord(op.Collection, mm, op.Validate)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
 			nc, err := r.UpdateRecord(ctx, fmt.Sprintf("%s/%s", op.Collection, *op.Rkey), &mm)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			d, err := atdata.MarshalCBOR(mm)
 			if err != nil {
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			entries = append(entries, models.Record{
@@ -240,7 +362,7 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 				Type:             to.StringPtr(OpTypeUpdate.String()),
 				Uri:              to.StringPtr("at://" + urepo.Did + "/" + op.Collection + "/" + *op.Rkey),
 				Cid:              to.StringPtr(nc.String()),
-				ValidationStatus: to.StringPtr("valid"), // TODO: obviously this might not be true atm lol
+				ValidationStatus: to.StringPtr(status),
 			})
 		}
 	}
@@ -248,7 +370,7 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 	// commit and get the new root
 	newroot, rev, err := r.Commit(ctx, urepo.SignFor)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// create a buffer for dumping our new cbor into
@@ -260,13 +382,13 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 		Version: 1,
 	})
 	if _, err := carstore.LdWrite(buf, hb); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// get a diff of the changes to the repo
 	diffops, err := r.DiffSince(ctx, rootcid)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// create the repo ops for the given diff
@@ -301,79 +423,118 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 
 		blk, err := dbs.Get(ctx, c)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 
 		// write the block to the buffer
 		if _, err := carstore.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 	}
 
 	// write the writelog to the buffer
 	for _, op := range bs.GetWriteLog() {
 		if _, err := carstore.LdWrite(buf, op.Cid().Bytes(), op.RawData()); err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 	}
 
-	// blob blob blob blob blob :3
 	var blobs []lexutil.LexLink
-	for _, entry := range entries {
-		var cids []cid.Cid
-		// whenever there is cid present, we know it's a create (dumb)
-		if entry.Cid != "" {
-			if err := rm.s.db.Create(ctx, &entry, []clause.Expression{clause.OnConflict{
-				Columns:   []clause.Column{{Name: "did"}, {Name: "nsid"}, {Name: "rkey"}},
-				UpdateAll: true,
-			}}).Error; err != nil {
-				return nil, err
-			}
+	var unreferenced []models.Blob
+	var evt *events.XRPCStreamEvent
+
+	// everything gets written out in one transaction, so that blocks, the records index, blob refs, the repo root and the
+	// firehose event either all get stored or none of them do
+	if err := rm.db.Transaction(ctx, func(tx *db.DB) error {
+		newblocks := make([]blocks.Block, 0, len(bs.GetWriteLog()))
+		for _, blk := range bs.GetWriteLog() {
+			newblocks = append(newblocks, blk)
+		}
 
-			// increment the given blob refs, yay
-			cids, err = rm.incrementBlobRefs(ctx, urepo, entry.Value)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			// as i noted above this is dumb. but we delete whenever the cid is nil. it works solely becaue the pkey
-			// is did + collection + rkey. i still really want to separate that out, or use a different type to make
-			// this less confusing/easy to read. alas, its 2 am and yea no
-			if err := rm.s.db.Delete(ctx, &entry, nil).Error; err != nil {
-				return nil, err
+		if err := rm.s.getTxBlockstore(tx, urepo.Did, rev).PutMany(ctx, newblocks); err != nil {
+			return err
+		}
+
+		// blob blob blob blob blob :3
+		for _, entry := range entries {
+			var cids []cid.Cid
+			// whenever there is cid present, we know it's a create (dumb)
+			if entry.Cid != "" {
+				// if this replaces an existing record, the blobs that it referenced lose a ref. grab it before it gets
+				// overwritten below
+				var old []models.Record
+				if err := tx.Raw(ctx, "SELECT value FROM records WHERE did = ? AND nsid = ? AND rkey = ?", nil, entry.Did, entry.Nsid, entry.Rkey).Scan(&old).Error; err != nil {
+					return err
+				}
+
+				if err := tx.Create(ctx, &entry, []clause.Expression{clause.OnConflict{
+					Columns:   []clause.Column{{Name: "did"}, {Name: "nsid"}, {Name: "rkey"}},
+					UpdateAll: true,
+				}}).Error; err != nil {
+					return err
+				}
+
+				// increment the given blob refs, yay
+				cids, err = rm.incrementBlobRefs(ctx, tx, urepo, entry.Value)
+				if err != nil {
+					return err
+				}
+
+				// the new refs have to be added first, so that a blob that is kept by the update never drops to zero
+				for _, rec := range old {
+					if len(rec.Value) == 0 {
+						continue
+					}
+
+					_, deleted, err := rm.decrementBlobRefs(ctx, tx, urepo, rec.Value)
+					if err != nil {
+						return err
+					}
+					unreferenced = append(unreferenced, deleted...)
+				}
+			} else {
+				// as i noted above this is dumb. but we delete whenever the cid is nil. it works solely becaue the pkey
+				// is did + collection + rkey. i still really want to separate that out, or use a different type to make
+				// this less confusing/easy to read. alas, its 2 am and yea no
+				if err := tx.Delete(ctx, &entry, nil).Error; err != nil {
+					return err
+				}
+
+				var deleted []models.Blob
+				cids, deleted, err = rm.decrementBlobRefs(ctx, tx, urepo, entry.Value)
+				if err != nil {
+					return err
+				}
+				unreferenced = append(unreferenced, deleted...)
 			}
 
-			// TODO:
-			cids, err = rm.decrementBlobRefs(ctx, urepo, entry.Value)
-			if err != nil {
-				return nil, err
+			// add all the relevant blobs to the blobs list of blobs. blob ^.^
+			for _, c := range cids {
+				blobs = append(blobs, lexutil.LexLink(c))
 			}
 		}
 
-		// add all the relevant blobs to the blobs list of blobs. blob ^.^
-		for _, c := range cids {
-			blobs = append(blobs, lexutil.LexLink(c))
+		if err := rm.swapRepoRoot(ctx, tx, urepo.Did, rootcid, newroot, rev); err != nil {
+			return err
 		}
-	}
 
-	// NOTE: using the request ctx seems a bit suss here, so using a background context. i'm not sure if this
-	// runs sync or not
-	rm.s.evtman.AddEvent(context.Background(), &events.XRPCStreamEvent{
-		RepoCommit: &atproto.SyncSubscribeRepos_Commit{
-			Repo:   urepo.Did,
-			Blocks: buf.Bytes(),
-			Blobs:  blobs,
-			Rev:    rev,
-			Since:  &urepo.Rev,
-			Commit: lexutil.LexLink(newroot),
-			Time:   time.Now().Format(time.RFC3339Nano),
-			Ops:    ops,
-			TooBig: false,
-		},
-	})
+		evt = &events.XRPCStreamEvent{
+			RepoCommit: &atproto.SyncSubscribeRepos_Commit{
+				Repo:   urepo.Did,
+				Blocks: buf.Bytes(),
+				Blobs:  blobs,
+				Rev:    rev,
+				Since:  &urepo.Rev,
+				Commit: lexutil.LexLink(newroot),
+				Time:   time.Now().Format(time.RFC3339Nano),
+				Ops:    ops,
+				TooBig: false,
+			},
+		}
 
-	if err := rm.s.UpdateRepo(ctx, urepo.Did, newroot, rev); err != nil {
-		return nil, err
+		return rm.s.evtpersister.PersistTx(ctx, tx, evt)
+	}); err != nil {
+		return nil, nil, nil, err
 	}
 
 	for i := range results {
@@ -384,7 +545,47 @@ func (rm *RepoMan) applyWrites(ctx context.Context, urepo models.Repo, writes []
 		}
 	}
 
-	return results, nil
+	return results, evt, unreferenced, nil
+}
+
+// validateRecord checks a record against its lexicon and returns the validation status to report back to the client. a
+// nil validate only validates records with a known lexicon, true requires the lexicon to be known, and false skips
+// validation altogether
+func (rm *RepoMan) validateRecord(collection string, rec MarshalableMap, validate *bool) (string, error) {
+	if validate != nil && !*validate {
+		return "unknown", nil
+	}
+
+	if !rm.s.lexicons.HasRecord(collection) {
+		if validate != nil {
+			return "", fmt.Errorf("%w for %s: lexicon not found", ErrInvalidRecord, collection)
+		}
+		return "unknown", nil
+	}
+
+	if err := rm.s.lexicons.ValidateRecord(collection, rec); err != nil {
+		return "", fmt.Errorf("%w for %s: %w", ErrInvalidRecord, collection, err)
+	}
+
+	return "valid", nil
+}
+
+// ErrConcurrentWrite is returned whenever the repo root changed underneath us while we were applying writes. the repo lock
+// prevents this inside of a single process, but multiple instances can share the same postgres database
+var ErrConcurrentWrite = errors.New("repo was modified concurrently")
+
+// swapRepoRoot moves the repo from prevroot to root, failing if something else has updated the root in the meantime
+func (rm *RepoMan) swapRepoRoot(ctx context.Context, tx *db.DB, did string, prevroot, root cid.Cid, rev string) error {
+	res := tx.Exec(ctx, "UPDATE repos SET root = ?, rev = ? WHERE did = ? AND root = ?", nil, root.Bytes(), rev, did, prevroot.Bytes())
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrConcurrentWrite
+	}
+
+	return nil
 }
 
 // this is a fun little guy. to get a proof, we need to read the record out of the blockstore and record how we actually
@@ -411,14 +612,14 @@ func (rm *RepoMan) getRecordProof(ctx context.Context, urepo models.Repo, collec
 	return c, bs.GetReadLog(), nil
 }
 
-func (rm *RepoMan) incrementBlobRefs(ctx context.Context, urepo models.Repo, cbor []byte) ([]cid.Cid, error) {
-	cids, err := getBlobCidsFromCbor(cbor)
+func (rm *RepoMan) incrementBlobRefs(ctx context.Context, tx *db.DB, urepo models.Repo, cbor []byte) ([]cid.Cid, error) {
+	cids, err := blobstore.RecordBlobCids(cbor)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, c := range cids {
-		if err := rm.db.Exec(ctx, "UPDATE blobs SET ref_count = ref_count + 1 WHERE did = ? AND cid = ?", nil, urepo.Did, c.Bytes()).Error; err != nil {
+		if err := tx.Exec(ctx, "UPDATE blobs SET ref_count = ref_count + 1 WHERE did = ? AND cid = ?", nil, urepo.Did, c.Bytes()).Error; err != nil {
 			return nil, err
 		}
 	}
@@ -426,74 +627,34 @@ func (rm *RepoMan) incrementBlobRefs(ctx context.Context, urepo models.Repo, cbo
 	return cids, nil
 }
 
-func (rm *RepoMan) decrementBlobRefs(ctx context.Context, urepo models.Repo, cbor []byte) ([]cid.Cid, error) {
-	cids, err := getBlobCidsFromCbor(cbor)
+// decrementBlobRefs drops the ref count of every blob referenced in the record, and deletes the rows for any blob that
+// no longer has any references. the deleted blobs are returned so their data can be removed from the blobstore once the
+// transaction has been committed
+func (rm *RepoMan) decrementBlobRefs(ctx context.Context, tx *db.DB, urepo models.Repo, cbor []byte) ([]cid.Cid, []models.Blob, error) {
+	cids, err := blobstore.RecordBlobCids(cbor)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	var deleted []models.Blob
 	for _, c := range cids {
-		var res struct {
-			ID    uint
-			Count int
-		}
-		if err := rm.db.Raw(ctx, "UPDATE blobs SET ref_count = ref_count - 1 WHERE did = ? AND cid = ? RETURNING id, ref_count", nil, urepo.Did, c.Bytes()).Scan(&res).Error; err != nil {
-			return nil, err
+		// the same blob can have been uploaded more than once, so there may be more than one row for it
+		var updated []models.Blob
+		if err := tx.Raw(ctx, "UPDATE blobs SET ref_count = ref_count - 1 WHERE did = ? AND cid = ? RETURNING *", nil, urepo.Did, c.Bytes()).Scan(&updated).Error; err != nil {
+			return nil, nil, err
 		}
 
-		// TODO: this does _not_ handle deletions of blobs that are on s3 storage!!!! we need to get the blob, see what
-		// storage it is in, and clean up s3!!!!
-		if res.Count == 0 {
-			if err := rm.db.Exec(ctx, "DELETE FROM blobs WHERE id = ?", nil, res.ID).Error; err != nil {
-				return nil, err
-			}
-			if err := rm.db.Exec(ctx, "DELETE FROM blob_parts WHERE blob_id = ?", nil, res.ID).Error; err != nil {
-				return nil, err
+		for _, blob := range updated {
+			if blob.RefCount > 0 {
+				continue
 			}
-		}
-	}
-
-	return cids, nil
-}
-
-// to be honest, we could just store both the cbor and non-cbor in []entries above to avoid an additional
-// unmarshal here. this will work for now though
-func getBlobCidsFromCbor(cbor []byte) ([]cid.Cid, error) {
-	var cids []cid.Cid
 
-	decoded, err := atdata.UnmarshalCBOR(cbor)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling cbor: %w", err)
-	}
-
-	var deepiter func(any) error
-	deepiter = func(item any) error {
-		switch val := item.(type) {
-		case map[string]any:
-			if val["$type"] == "blob" {
-				if ref, ok := val["ref"].(string); ok {
-					c, err := cid.Parse(ref)
-					if err != nil {
-						return err
-					}
-					cids = append(cids, c)
-				}
-				for _, v := range val {
-					return deepiter(v)
-				}
-			}
-		case []any:
-			for _, v := range val {
-				deepiter(v)
+			if err := tx.Exec(ctx, "DELETE FROM blobs WHERE id = ?", nil, blob.ID).Error; err != nil {
+				return nil, nil, err
 			}
+			deleted = append(deleted, blob)
 		}
-
-		return nil
 	}
 
-	if err := deepiter(decoded); err != nil {
-		return nil, err
-	}
-
-	return cids, nil
+	return cids, deleted, nil
 }
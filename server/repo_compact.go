@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	"github.com/ipfs/go-cid"
+)
+
+func (s *Server) repoCompactRoutine(ctx context.Context) {
+	if s.repoCompactInterval <= 0 {
+		return
+	}
+
+	logger := s.logger.With("component", "repo-compact")
+
+	compact := func() {
+		n, size, err := s.compactRepos(ctx)
+		if err != nil {
+			logger.Error("error compacting repos", "err", err)
+		}
+		logger.Info("compacted repos", "blocks", n, "bytes", size)
+	}
+
+	// compacting walks every repo on the pds, so unlike the other routines we don't run it right away on startup
+	ticker := time.NewTicker(s.repoCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			compact()
+		}
+	}
+}
+
+// compactRepos compacts every repo on the pds, returning how many blocks were deleted and how many bytes they took up
+func (s *Server) compactRepos(ctx context.Context) (int, int64, error) {
+	var dids []string
+	if err := s.db.Raw(ctx, "SELECT did FROM repos ORDER BY did ASC", nil).Scan(&dids).Error; err != nil {
+		return 0, 0, err
+	}
+
+	var count int
+	var reclaimed int64
+	for _, did := range dids {
+		if err := ctx.Err(); err != nil {
+			return count, reclaimed, err
+		}
+
+		res, err := s.compactRepo(ctx, did)
+		if err != nil {
+			s.logger.Error("error compacting repo", "did", did, "error", err)
+			continue
+		}
+
+		count += res.Deleted
+		reclaimed += res.Bytes
+	}
+
+	return count, reclaimed, nil
+}
+
+// compactRepo deletes the blocks of a repo that aren't reachable from its root, keeping enough history for the repo's
+// state at any point in the retention window. readers like getRepo don't take the repo lock, so the window also keeps
+// them from losing blocks out from under them partway through
+func (s *Server) compactRepo(ctx context.Context, did string) (*sqlite_blockstore.CompactResult, error) {
+	unlock := s.repoman.lockRepo(did)
+	defer unlock()
+
+	var row struct {
+		Root []byte
+	}
+	if err := s.db.Raw(ctx, "SELECT root FROM repos WHERE did = ?", nil, did).Scan(&row).Error; err != nil {
+		return nil, err
+	}
+
+	rc, err := cid.Cast(row.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var keepSince string
+	if s.repoHistoryRetention > 0 {
+		keepSince = syntax.NewTID(time.Now().Add(-s.repoHistoryRetention).UnixMicro(), 0).String()
+	}
+
+	return sqlite_blockstore.Compact(ctx, s.db, sqlite_blockstore.CompactArgs{
+		Did:       did,
+		Root:      rc,
+		KeepSince: keepSince,
+		Cache:     s.blockCache,
+	})
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/google/uuid"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/internal/repowalk"
+	"github.com/haileyok/cocoon/models"
+	"github.com/haileyok/cocoon/repo_indexer"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// importProgressInterval is how many blocks are read between each progress log line
+	importProgressInterval = 10_000
+	importInsertBatchSize  = 500
+)
+
+// errInvalidImport is wrapped by every error caused by the car itself rather than something on our end
+var errInvalidImport = errors.New("invalid repo")
+
+// importProgress is updated as an import goes, so it can be reported while the import is still running
+type importProgress struct {
+	blocks  atomic.Int64
+	records atomic.Int64
+}
+
+// importRepo replaces the contents of a repo with the repo in a car. the car is read as a stream, and the repo in it
+// has to be complete, belong to the account, and be signed by the account's current signing key. the imported records
+// get a new commit signed with our own key, and everything the repo had before is swapped out in a single transaction
+func (s *Server) importRepo(ctx context.Context, urepo *models.Repo, r io.Reader, progress *importProgress) error {
+	logger := s.logger.With("did", urepo.Did)
+
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: error reading car header: %w", errInvalidImport, err)
+	}
+
+	if len(cr.Header.Roots) != 1 {
+		return fmt.Errorf("%w: car must have exactly one root", errInvalidImport)
+	}
+	root := cr.Header.Roots[0]
+
+	// the whole repo has to be on hand to walk it, but nothing gets written to the repo until we know it's good. the
+	// blocks are staged in the db instead of memory, since a repo can be much bigger than what we'd want to hold on to
+	bs := newImportBlockstore(s.db, uuid.NewString())
+	defer func() {
+		// this still has to happen when the import was cancelled
+		if err := bs.clear(context.WithoutCancel(ctx)); err != nil {
+			logger.Error("error clearing staged import blocks", "error", err)
+		}
+	}()
+
+	batch := make([]blocks.Block, 0, importInsertBatchSize)
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		// this also fails for any block that doesn't match its cid
+		if err != nil {
+			return fmt.Errorf("%w: error reading block: %w", errInvalidImport, err)
+		}
+
+		batch = append(batch, blk)
+		if len(batch) == importInsertBatchSize {
+			if err := bs.PutMany(ctx, batch); err != nil {
+				return fmt.Errorf("error staging blocks: %w", err)
+			}
+			batch = batch[:0]
+		}
+
+		if n := progress.blocks.Add(1); n%importProgressInterval == 0 {
+			logger.Info("reading repo import", "blocks", n)
+		}
+	}
+
+	if err := bs.PutMany(ctx, batch); err != nil {
+		return fmt.Errorf("error staging blocks: %w", err)
+	}
+
+	logger.Info("read repo import", "blocks", progress.blocks.Load())
+
+	if err := s.verifyImportCommit(ctx, bs, urepo.Did, root); err != nil {
+		return err
+	}
+
+	imported, err := repo.OpenRepo(ctx, bs, root)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidImport, err)
+	}
+
+	// the new commit block gets staged along with everything else
+	newroot, rev, err := imported.Commit(ctx, urepo.SignFor)
+	if err != nil {
+		return fmt.Errorf("error committing imported repo: %w", err)
+	}
+
+	commitBlock, err := bs.Get(ctx, newroot)
+	if err != nil {
+		return fmt.Errorf("error getting new commit block: %w", err)
+	}
+
+	// the whole repo changed, so a #sync tells everyone downstream to drop what they had and start over from here
+	buf := new(bytes.Buffer)
+	hb, err := cbor.DumpObject(&car.CarHeader{
+		Roots:   []cid.Cid{newroot},
+		Version: 1,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := carstore.LdWrite(buf, hb); err != nil {
+		return err
+	}
+	if _, err := carstore.LdWrite(buf, commitBlock.Cid().Bytes(), commitBlock.RawData()); err != nil {
+		return err
+	}
+
+	evt := &events.XRPCStreamEvent{
+		RepoSync: &atproto.SyncSubscribeRepos_Sync{
+			Did:    urepo.Did,
+			Blocks: buf.Bytes(),
+			Rev:    rev,
+			Time:   time.Now().Format(time.RFC3339Nano),
+		},
+	}
+
+	unlock := s.repoman.lockRepo(urepo.Did)
+	defer unlock()
+
+	var nblocks int
+	if err := s.db.Transaction(ctx, func(tx *db.DB) error {
+		if err := tx.Exec(ctx, "DELETE FROM blocks WHERE did = ?", nil, urepo.Did).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(ctx, "DELETE FROM records WHERE did = ?", nil, urepo.Did).Error; err != nil {
+			return err
+		}
+
+		staged := newImportBlockstore(tx, bs.id)
+
+		// only what our commit can reach gets stored, which leaves out the old commit and anything else extra in the car.
+		// the walk also makes sure that nothing the repo needs is missing. errors from our own writes are kept apart, so
+		// that they aren't blamed on the car
+		var writeErr error
+		rows := make([]models.Block, 0, importInsertBatchSize)
+		flushBlocks := func() error {
+			if len(rows) == 0 {
+				return nil
+			}
+			// a record can be in the repo more than once, so the same block can come up again in the walk
+			if err := tx.Create(ctx, &rows, []clause.Expression{clause.OnConflict{DoNothing: true}}).Error; err != nil {
+				writeErr = fmt.Errorf("could not insert blocks: %w", err)
+				return writeErr
+			}
+			rows = rows[:0]
+			return nil
+		}
+
+		if err := repowalk.Walk(ctx, staged, newroot, nil, func(blk blocks.Block) error {
+			nblocks++
+			rows = append(rows, models.Block{
+				Did:   urepo.Did,
+				Cid:   blk.Cid().Bytes(),
+				Rev:   rev,
+				Value: blk.RawData(),
+			})
+			if len(rows) < importInsertBatchSize {
+				return nil
+			}
+			return flushBlocks()
+		}); err != nil {
+			if writeErr != nil {
+				return writeErr
+			}
+			return fmt.Errorf("%w: %w", errInvalidImport, err)
+		}
+		if err := flushBlocks(); err != nil {
+			return err
+		}
+
+		records := make([]models.Record, 0, importInsertBatchSize)
+		flushRecords := func() error {
+			if len(records) == 0 {
+				return nil
+			}
+			if err := tx.Create(ctx, &records, nil).Error; err != nil {
+				writeErr = fmt.Errorf("could not insert records: %w", err)
+				return writeErr
+			}
+			records = records[:0]
+			return nil
+		}
+
+		if err := repo_indexer.ForEachRecordRow(ctx, staged, urepo.Did, newroot, nil, func(rec models.Record) error {
+			progress.records.Add(1)
+			records = append(records, rec)
+			if len(records) < importInsertBatchSize {
+				return nil
+			}
+			return flushRecords()
+		}); err != nil {
+			if writeErr != nil {
+				return writeErr
+			}
+			return fmt.Errorf("%w: %w", errInvalidImport, err)
+		}
+		if err := flushRecords(); err != nil {
+			return err
+		}
+
+		if err := s.UpdateRepo(ctx, tx, urepo.Did, newroot, rev); err != nil {
+			return fmt.Errorf("error updating repo after commit: %w", err)
+		}
+
+		// blobs are usually uploaded after the repo during a migration, but any that are already here need their refs
+		if _, err := blobstore.RecountRefs(ctx, tx, urepo.Did); err != nil {
+			return fmt.Errorf("error counting blob refs: %w", err)
+		}
+
+		return s.evtpersister.PersistTx(ctx, tx, evt)
+	}); err != nil {
+		return err
+	}
+
+	// the blocks that were replaced may still be cached
+	if s.blockCache != nil {
+		s.blockCache.RemoveRepo(urepo.Did)
+	}
+
+	if err := s.evtpersister.Broadcast(ctx, evt); err != nil {
+		logger.Error("error broadcasting sync event", "error", err)
+	}
+
+	logger.Info("imported repo", "blocks", nblocks, "records", progress.records.Load(), "rev", rev)
+
+	return nil
+}
+
+// verifyImportCommit makes sure the commit at the root of an imported car is for the account doing the import, and
+// that it was signed with their current signing key
+func (s *Server) verifyImportCommit(ctx context.Context, bs blockstore.Blockstore, did string, root cid.Cid) error {
+	blk, err := bs.Get(ctx, root)
+	if err != nil {
+		return fmt.Errorf("%w: car is missing its commit block", errInvalidImport)
+	}
+
+	var sc repo.SignedCommit
+	if err := sc.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+		return fmt.Errorf("%w: error decoding commit: %w", errInvalidImport, err)
+	}
+
+	if sc.Did != did {
+		return fmt.Errorf("%w: commit is for %s, not %s", errInvalidImport, sc.Did, did)
+	}
+
+	key, err := s.resolveSigningKey(ctx, did)
+	if err != nil {
+		return fmt.Errorf("error resolving signing key: %w", err)
+	}
+
+	unsigned, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return fmt.Errorf("%w: error encoding commit: %w", errInvalidImport, err)
+	}
+
+	if err := key.HashAndVerifyLenient(unsigned, sc.Sig); err != nil {
+		return fmt.Errorf("%w: commit isn't signed by the did's signing key", errInvalidImport)
+	}
+
+	return nil
+}
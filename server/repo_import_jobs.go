@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+)
+
+const (
+	DefaultImportMaxSize = 2_000_000_000
+
+	importStateQueued     = "queued"
+	importStateProcessing = "processing"
+	importStateDone       = "done"
+	importStateFailed     = "failed"
+)
+
+// errImportInProgress is returned when an account that already has an import queued or running tries to start another
+var errImportInProgress = errors.New("an import is already queued or running for this account")
+
+// checkNoActiveImport returns errImportInProgress if the account has an import job that isn't finished yet. two jobs
+// for the same repo would each swap out whatever the other one imported
+func (s *Server) checkNoActiveImport(ctx context.Context, tx *db.DB, did string) error {
+	var count int64
+	if err := tx.Raw(ctx, "SELECT COUNT(*) FROM import_jobs WHERE did = ? AND state IN ?", nil, did, []string{importStateQueued, importStateProcessing}).Scan(&count).Error; err != nil {
+		return fmt.Errorf("error checking for active import jobs: %w", err)
+	}
+
+	if count > 0 {
+		return errImportInProgress
+	}
+
+	return nil
+}
+
+func (s *Server) importSpoolPath(id string) string {
+	return filepath.Join(s.importSpoolDir, id+".car")
+}
+
+// wakeImports lets the import routine know that a job was queued. it never blocks, since one wake up is enough for the
+// routine to work through everything that's queued
+func (s *Server) wakeImports() {
+	select {
+	case s.importWake <- struct{}{}:
+	default:
+	}
+}
+
+// recoverImportJobs gets import jobs ready to run again after a restart. it has to run before the
+// server starts taking requests, otherwise it could remove a car that's still being spooled
+func (s *Server) recoverImportJobs(ctx context.Context) error {
+	// a job that was processing when the server went down gets started over. the repo is only swapped in at the very end
+	// with a single transaction, so an import that didn't finish didn't leave anything behind in the repo
+	if err := s.db.Exec(ctx, "UPDATE import_jobs SET state = ?, blocks = 0, records = 0 WHERE state = ?", nil, importStateQueued, importStateProcessing).Error; err != nil {
+		return fmt.Errorf("error requeueing import jobs: %w", err)
+	}
+
+	if err := s.cleanImportSpool(ctx); err != nil {
+		return fmt.Errorf("error cleaning import spool: %w", err)
+	}
+
+	// no imports are running yet, so any staged blocks belong to one that never got to clean up after itself
+	if err := s.db.Exec(ctx, "DELETE FROM import_blocks", nil).Error; err != nil {
+		return fmt.Errorf("error clearing staged import blocks: %w", err)
+	}
+
+	return nil
+}
+
+// importJobRoutine imports the repos of queued import jobs one at a time, oldest first
+func (s *Server) importJobRoutine(ctx context.Context) {
+	logger := s.logger.With("component", "repo-import")
+
+	for {
+		if err := s.runImportJobs(ctx, logger); err != nil && ctx.Err() == nil {
+			logger.Error("error running import jobs", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.importWake:
+		}
+	}
+}
+
+// runImportJobs works through queued import jobs until there are none left
+func (s *Server) runImportJobs(ctx context.Context, logger *slog.Logger) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var job models.ImportJob
+		res := s.db.Raw(ctx, "SELECT * FROM import_jobs WHERE state = ? ORDER BY created_at ASC LIMIT 1", nil, importStateQueued).Scan(&job)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+
+		if err := s.runImportJob(ctx, logger, &job); err != nil {
+			return err
+		}
+	}
+}
+
+// runImportJob imports the car of a single job and records how it went. an error is only returned when the job's state
+// couldn't be saved, or when the server is shutting down and the job should be picked up again after a restart
+func (s *Server) runImportJob(ctx context.Context, logger *slog.Logger, job *models.ImportJob) error {
+	logger = logger.With("job", job.ID, "did", job.Did)
+
+	if err := s.setImportJobState(ctx, job, importStateProcessing, ""); err != nil {
+		return err
+	}
+
+	progress := &importProgress{}
+	s.importsRunning.Store(job.ID, progress)
+	defer s.importsRunning.Delete(job.ID)
+
+	logger.Info("starting import job")
+
+	err := s.importJob(ctx, job, progress)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	job.Blocks = progress.blocks.Load()
+	job.Records = progress.records.Load()
+
+	state, msg := importStateDone, ""
+	if err != nil {
+		state = importStateFailed
+		msg = "internal server error"
+		if errors.Is(err, errInvalidImport) {
+			msg = err.Error()
+		}
+		logger.Error("import job failed", "error", err)
+	} else {
+		logger.Info("finished import job", "blocks", job.Blocks, "records", job.Records)
+	}
+
+	if err := s.setImportJobState(ctx, job, state, msg); err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.importSpoolPath(job.ID)); err != nil && !os.IsNotExist(err) {
+		logger.Error("error removing spooled car", "error", err)
+	}
+
+	return nil
+}
+
+func (s *Server) importJob(ctx context.Context, job *models.ImportJob, progress *importProgress) error {
+	urepo, err := s.getRepoActorByDid(ctx, job.Did)
+	if err != nil {
+		return err
+	}
+	if urepo.Repo.Did == "" {
+		return fmt.Errorf("%w: account no longer exists", errInvalidImport)
+	}
+
+	f, err := os.Open(s.importSpoolPath(job.ID))
+	if err != nil {
+		return fmt.Errorf("error opening spooled car: %w", err)
+	}
+	defer f.Close()
+
+	return s.importRepo(ctx, &urepo.Repo, f, progress)
+}
+
+func (s *Server) setImportJobState(ctx context.Context, job *models.ImportJob, state, msg string) error {
+	job.State = state
+	job.Error = msg
+	job.UpdatedAt = time.Now()
+
+	if err := s.db.Exec(ctx, "UPDATE import_jobs SET state = ?, blocks = ?, records = ?, error = ?, updated_at = ? WHERE id = ?", nil, job.State, job.Blocks, job.Records, job.Error, job.UpdatedAt, job.ID).Error; err != nil {
+		return fmt.Errorf("error updating import job: %w", err)
+	}
+
+	return nil
+}
+
+// cleanImportSpool removes spooled cars that don't belong to a queued job. these are left behind when the server goes
+// down after a car was spooled but before its job was created, or before a finished job's car was removed
+func (s *Server) cleanImportSpool(ctx context.Context) error {
+	var ids []string
+	if err := s.db.Raw(ctx, "SELECT id FROM import_jobs WHERE state = ?", nil, importStateQueued).Scan(&ids).Error; err != nil {
+		return err
+	}
+
+	queued := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		queued[id] = struct{}{}
+	}
+
+	entries, err := os.ReadDir(s.importSpoolDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".car")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		if _, ok := queued[id]; ok {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.importSpoolDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipld/go-car"
+)
+
+// queueImportJob spools the car and creates a job for it in the given state
+func queueImportJob(t *testing.T, s *Server, id, did, state string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(s.importSpoolPath(id), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	job := models.ImportJob{
+		ID:    id,
+		Did:   did,
+		State: state,
+	}
+	if err := s.db.Create(context.Background(), &job, nil).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getImportJob(t *testing.T, s *Server, id string) models.ImportJob {
+	t.Helper()
+
+	var job models.ImportJob
+	if err := s.db.Raw(context.Background(), "SELECT * FROM import_jobs WHERE id = ?", nil, id).Scan(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return job
+}
+
+func countCarBlocks(t *testing.T, data []byte) int64 {
+	t.Helper()
+
+	cr, err := car.NewCarReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	for {
+		_, err := cr.Next()
+		if err == io.EOF {
+			return n
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func TestRunImportJobs(t *testing.T) {
+	s := newTestServer(t)
+	s.importSpoolDir = t.TempDir()
+
+	urepo := createTestRepo(t, s, "did:plc:test")
+	other := createTestRepo(t, s, "did:plc:other")
+	useTestSigningKey(t, s, urepo)
+
+	ctx := context.Background()
+
+	exported := make(map[string]struct{})
+	for i := range 20 {
+		rkey := fmt.Sprintf("post%02d", i)
+		if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost(rkey)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		exported[rkey] = struct{}{}
+	}
+
+	data := exportRepo(t, s, urepo.Did, nil)
+
+	if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost("later")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.repoman.applyWrites(ctx, other, []Op{testPost("kept")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	root, rev := currentRepo(t, s, other.Did)
+
+	queueImportJob(t, s, "valid", urepo.Did, importStateQueued, data)
+	queueImportJob(t, s, "invalid", other.Did, importStateQueued, []byte("not a car"))
+
+	if err := s.runImportJobs(ctx, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := getImportJob(t, s, "valid")
+	if valid.State != importStateDone || valid.Error != "" {
+		t.Errorf("expected valid job to be done, got %s (error: %q)", valid.State, valid.Error)
+	}
+	if n := countCarBlocks(t, data); valid.Blocks != n {
+		t.Errorf("expected %d blocks to be imported, got %d", n, valid.Blocks)
+	}
+	if valid.Records != int64(len(exported)) {
+		t.Errorf("expected %d records to be imported, got %d", len(exported), valid.Records)
+	}
+	checkRepoRecords(t, s, urepo.Did, exported)
+
+	invalid := getImportJob(t, s, "invalid")
+	if invalid.State != importStateFailed || !strings.HasPrefix(invalid.Error, errInvalidImport.Error()) {
+		t.Errorf("expected invalid job to fail as an invalid import, got %s (error: %q)", invalid.State, invalid.Error)
+	}
+	if invalid.Blocks != 0 || invalid.Records != 0 {
+		t.Errorf("expected nothing to be imported from the invalid job, got %d blocks and %d records", invalid.Blocks, invalid.Records)
+	}
+
+	newroot, newrev := currentRepo(t, s, other.Did)
+	if !newroot.Equals(root) || newrev != rev {
+		t.Errorf("expected repo to stay at %s, but it's at %s", rev, newrev)
+	}
+	checkRepoRecords(t, s, other.Did, map[string]struct{}{"kept": {}})
+
+	if n := spooledCars(t, s); n != 0 {
+		t.Errorf("expected finished jobs' cars to be removed, found %d spooled cars", n)
+	}
+	if n := countStagedBlocks(t, s); n != 0 {
+		t.Errorf("expected staged blocks to be cleared, found %d", n)
+	}
+}
+
+func TestRecoverImportJobs(t *testing.T) {
+	s := newTestServer(t)
+	s.importSpoolDir = t.TempDir()
+
+	urepo := createTestRepo(t, s, "did:plc:test")
+	useTestSigningKey(t, s, urepo)
+
+	ctx := context.Background()
+
+	if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost("a")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := exportRepo(t, s, urepo.Did, nil)
+
+	// the server went down partway through this job, after some of its progress was saved
+	queueImportJob(t, s, "interrupted", urepo.Did, importStateProcessing, data)
+	if err := s.db.Exec(ctx, "UPDATE import_jobs SET blocks = ?, records = ? WHERE id = ?", nil, 5, 1, "interrupted").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// this one finished, but its car was never removed
+	queueImportJob(t, s, "finished", urepo.Did, importStateDone, data)
+
+	// this car was spooled, but its job was never created
+	if err := os.WriteFile(s.importSpoolPath("orphaned"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// and these blocks were staged by the interrupted import
+	if err := s.db.Create(ctx, &models.ImportBlock{ImportID: "stale", Cid: []byte("cid"), Value: []byte("value")}, nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.recoverImportJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	job := getImportJob(t, s, "interrupted")
+	if job.State != importStateQueued {
+		t.Errorf("expected interrupted job to be queued again, got %s", job.State)
+	}
+	if job.Blocks != 0 || job.Records != 0 {
+		t.Errorf("expected interrupted job's counts to be reset, got %d blocks and %d records", job.Blocks, job.Records)
+	}
+
+	if _, err := os.Stat(s.importSpoolPath("interrupted")); err != nil {
+		t.Errorf("expected interrupted job's car to be kept: %v", err)
+	}
+	for _, id := range []string{"finished", "orphaned"} {
+		if _, err := os.Stat(s.importSpoolPath(id)); !os.IsNotExist(err) {
+			t.Errorf("expected %s car to be removed, got %v", id, err)
+		}
+	}
+
+	if n := countStagedBlocks(t, s); n != 0 {
+		t.Errorf("expected staged blocks to be cleared, found %d", n)
+	}
+
+	// the requeued job runs from the start like any other
+	if err := s.runImportJobs(ctx, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	job = getImportJob(t, s, "interrupted")
+	if job.State != importStateDone || job.Records != 1 {
+		t.Errorf("expected requeued job to import 1 record, got %s with %d records", job.State, job.Records)
+	}
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/carstore"
+	"github.com/haileyok/cocoon/identity"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"github.com/labstack/echo/v4"
+)
+
+// didDocTransport answers every request with the same did doc
+type didDocTransport struct {
+	doc []byte
+}
+
+func (t didDocTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(t.doc)),
+	}, nil
+}
+
+// useTestSigningKey makes the account's signing key resolve to the one it signs its repo with
+func useTestSigningKey(t *testing.T, s *Server, urepo models.Repo) {
+	t.Helper()
+
+	sk, err := atcrypto.ParsePrivateBytesK256(urepo.SigningKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := sk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := json.Marshal(identity.DidDoc{
+		Id: urepo.Did,
+		VerificationMethods: []identity.DidDocVerificationMethod{{
+			Id:                 urepo.Did + "#atproto",
+			Type:               "Multikey",
+			Controller:         urepo.Did,
+			PublicKeyMultibase: pub.Multibase(),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.passport = identity.NewPassport(&http.Client{Transport: didDocTransport{doc}}, identity.NewMemCache(10))
+}
+
+// exportRepo writes the whole repo to a car, the same way getRepo does. if skip is set, that block is left out
+func exportRepo(t *testing.T, s *Server, did string, skip func(cid.Cid) bool) []byte {
+	t.Helper()
+
+	root, _ := currentRepo(t, s, did)
+
+	hb, err := cbor.DumpObject(&car.CarHeader{
+		Roots:   []cid.Cid{root},
+		Version: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := new(bytes.Buffer)
+	if _, err := carstore.LdWrite(full, hb); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeRepoBlocks(context.Background(), full, did, root, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if skip == nil {
+		return full.Bytes()
+	}
+
+	cr, err := car.NewCarReader(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := carstore.LdWrite(buf, hb); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if skip(blk.Cid()) {
+			continue
+		}
+
+		if _, err := carstore.LdWrite(buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func countStagedBlocks(t *testing.T, s *Server) int64 {
+	t.Helper()
+
+	var count int64
+	if err := s.db.Raw(context.Background(), "SELECT COUNT(*) FROM import_blocks", nil).Scan(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestImportRepo(t *testing.T) {
+	s := newTestServer(t)
+	urepo := createTestRepo(t, s, "did:plc:test")
+	useTestSigningKey(t, s, urepo)
+
+	ctx := context.Background()
+
+	// enough records for the blocks and records to be written in more than one batch
+	exported := make(map[string]struct{})
+	for i := range importInsertBatchSize + 50 {
+		rkey := fmt.Sprintf("post%04d", i)
+		if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost(rkey)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		exported[rkey] = struct{}{}
+	}
+
+	data := exportRepo(t, s, urepo.Did, nil)
+
+	// anything written after the export gets replaced by the import
+	if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost("later")}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := &importProgress{}
+	if err := s.importRepo(ctx, &urepo, bytes.NewReader(data), progress); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := progress.records.Load(); n != int64(len(exported)) {
+		t.Errorf("expected %d records to be imported, got %d", len(exported), n)
+	}
+
+	checkRepoRecords(t, s, urepo.Did, exported)
+
+	if n := countStagedBlocks(t, s); n != 0 {
+		t.Errorf("expected staged blocks to be cleared, found %d", n)
+	}
+}
+
+func TestImportRepoMissingBlock(t *testing.T) {
+	s := newTestServer(t)
+	urepo := createTestRepo(t, s, "did:plc:test")
+	useTestSigningKey(t, s, urepo)
+
+	ctx := context.Background()
+
+	rkeys := make(map[string]struct{})
+	for _, rkey := range []string{"a", "b", "c"} {
+		if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost(rkey)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		rkeys[rkey] = struct{}{}
+	}
+
+	// the block for one of the records is left out of the car
+	var record models.Record
+	if err := s.db.Raw(ctx, "SELECT * FROM records WHERE did = ? AND rkey = ?", nil, urepo.Did, "b").Scan(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	missing, err := cid.Decode(record.Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := exportRepo(t, s, urepo.Did, func(c cid.Cid) bool {
+		return c.Equals(missing)
+	})
+
+	checkImportRejected(t, s, urepo, data, rkeys)
+}
+
+// checkImportRejected imports the car and makes sure that it's rejected as invalid without changing anything about the
+// repo, which should hold exactly the given rkeys
+func checkImportRejected(t *testing.T, s *Server, urepo models.Repo, data []byte, rkeys map[string]struct{}) {
+	t.Helper()
+
+	root, rev := currentRepo(t, s, urepo.Did)
+
+	err := s.importRepo(context.Background(), &urepo, bytes.NewReader(data), &importProgress{})
+	if !errors.Is(err, errInvalidImport) {
+		t.Fatalf("expected an invalid import, got %v", err)
+	}
+
+	newroot, newrev := currentRepo(t, s, urepo.Did)
+	if !newroot.Equals(root) || newrev != rev {
+		t.Errorf("expected repo to stay at %s, but it's at %s", rev, newrev)
+	}
+	checkRepoRecords(t, s, urepo.Did, rkeys)
+
+	if n := countStagedBlocks(t, s); n != 0 {
+		t.Errorf("expected staged blocks to be cleared, found %d", n)
+	}
+}
+
+func TestImportRepoUnverifiedCommit(t *testing.T) {
+	tests := []struct {
+		name string
+		// car returns the car to import into urepo
+		car func(t *testing.T, s *Server, urepo models.Repo) []byte
+	}{
+		{
+			name: "commit for another did",
+			car: func(t *testing.T, s *Server, urepo models.Repo) []byte {
+				other := createTestRepo(t, s, "did:plc:other")
+				if _, err := s.repoman.applyWrites(context.Background(), other, []Op{testPost("other")}, nil); err != nil {
+					t.Fatal(err)
+				}
+				useTestSigningKey(t, s, other)
+
+				return exportRepo(t, s, other.Did, nil)
+			},
+		},
+		{
+			name: "commit signed with another key",
+			car: func(t *testing.T, s *Server, urepo models.Repo) []byte {
+				k, err := atcrypto.GeneratePrivateKeyK256()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the did resolves to a key other than the one the repo is signed with
+				rotated := urepo
+				rotated.SigningKey = k.Bytes()
+				useTestSigningKey(t, s, rotated)
+
+				return exportRepo(t, s, urepo.Did, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			urepo := createTestRepo(t, s, "did:plc:test")
+			useTestSigningKey(t, s, urepo)
+
+			rkeys := make(map[string]struct{})
+			for _, rkey := range []string{"a", "b", "c"} {
+				if _, err := s.repoman.applyWrites(context.Background(), urepo, []Op{testPost(rkey)}, nil); err != nil {
+					t.Fatal(err)
+				}
+				rkeys[rkey] = struct{}{}
+			}
+
+			checkImportRejected(t, s, urepo, tt.car(t, s, urepo), rkeys)
+		})
+	}
+}
+
+func TestImportRepoTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	urepo := createTestRepo(t, s, "did:plc:test")
+	useTestSigningKey(t, s, urepo)
+
+	ctx := context.Background()
+
+	rkeys := make(map[string]struct{})
+	for _, rkey := range []string{"a", "b", "c"} {
+		if _, err := s.repoman.applyWrites(ctx, urepo, []Op{testPost(rkey)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		rkeys[rkey] = struct{}{}
+	}
+
+	data := exportRepo(t, s, urepo.Did, nil)
+	root, rev := currentRepo(t, s, urepo.Did)
+
+	importRepo := func(body io.Reader) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodPost, "/xrpc/com.atproto.repo.importRepo", body)
+		req.Header.Set("content-type", "application/vnd.ipld.car")
+		rec := httptest.NewRecorder()
+
+		c := echo.New().NewContext(req, rec)
+		c.Set("repo", &models.RepoActor{Repo: urepo})
+
+		if err := s.handleRepoImportRepo(c); err != nil {
+			t.Fatal(err)
+		}
+
+		return rec
+	}
+
+	// the body is streamed without a content length, so the limit has to be caught while the car is being read
+	s.importMaxSize = int64(len(data) - 1)
+	rec := importRepo(io.NopCloser(bytes.NewReader(data)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a car over the limit to be rejected, got %d", rec.Code)
+	}
+
+	newroot, newrev := currentRepo(t, s, urepo.Did)
+	if !newroot.Equals(root) || newrev != rev {
+		t.Errorf("expected repo to stay at %s, but it's at %s", rev, newrev)
+	}
+	checkRepoRecords(t, s, urepo.Did, rkeys)
+
+	if n := countStagedBlocks(t, s); n != 0 {
+		t.Errorf("expected staged blocks to be cleared, found %d", n)
+	}
+
+	s.importMaxSize = int64(len(data))
+	rec = importRepo(bytes.NewReader(data))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a car at the limit to be imported, got %d: %s", rec.Code, rec.Body)
+	}
+}
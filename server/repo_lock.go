@@ -0,0 +1,47 @@
+package server
+
+import "sync"
+
+// repoLocks hands out a mutex per did, so that writes to a single repo are serialized while writes to different repos
+// can still happen in parallel. that is only true for building the commit though. db.Transaction holds the write lock
+// of the db.DB for the whole transaction, so the writes to the database still happen one at a time across all repos.
+// entries are removed once nobody is holding or waiting on them anymore.
+type repoLocks struct {
+	mu    sync.Mutex
+	locks map[string]*repoLock
+}
+
+type repoLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newRepoLocks() *repoLocks {
+	return &repoLocks{
+		locks: make(map[string]*repoLock),
+	}
+}
+
+func (rl *repoLocks) lock(did string) func() {
+	rl.mu.Lock()
+	l, ok := rl.locks[did]
+	if !ok {
+		l = &repoLock{}
+		rl.locks[did] = l
+	}
+	l.refs++
+	rl.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		rl.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(rl.locks, did)
+		}
+		rl.mu.Unlock()
+	}
+}
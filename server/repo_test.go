@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/haileyok/cocoon/models"
+	"github.com/ipfs/go-cid"
+)
+
+func testPost(rkey string) Op {
+	return Op{
+		Type:       OpTypeCreate,
+		Collection: "app.bsky.feed.post",
+		Rkey:       &rkey,
+		Record: &MarshalableMap{
+			"$type":     "app.bsky.feed.post",
+			"text":      rkey,
+			"createdAt": "2024-01-01T00:00:00Z",
+		},
+	}
+}
+
+// checkRepoRecords makes sure that the repo's mst and the records index hold exactly the given rkeys
+func checkRepoRecords(t *testing.T, s *Server, did string, rkeys map[string]struct{}) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	var current models.Repo
+	if err := s.db.Raw(ctx, "SELECT * FROM repos WHERE did = ?", nil, did).Scan(&current).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := cid.Cast(current.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := repo.OpenRepo(ctx, s.getBlockstore(did), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]int)
+	if err := r.ForEach(ctx, "", func(k string, v cid.Cid) error {
+		seen[k]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != len(rkeys) {
+		t.Errorf("%s: expected %d records in the mst, found %d", did, len(rkeys), len(seen))
+	}
+	for rkey := range rkeys {
+		if n := seen["app.bsky.feed.post/"+rkey]; n != 1 {
+			t.Errorf("%s: expected record %s to be in the mst once, found it %d times", did, rkey, n)
+		}
+	}
+
+	var indexed []string
+	if err := s.db.Raw(ctx, "SELECT rkey FROM records WHERE did = ?", nil, did).Scan(&indexed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(indexed) != len(rkeys) {
+		t.Errorf("%s: expected %d indexed records, found %d", did, len(rkeys), len(indexed))
+	}
+	for _, rkey := range indexed {
+		if _, ok := rkeys[rkey]; !ok {
+			t.Errorf("%s: unexpected indexed record %s", did, rkey)
+		}
+	}
+}
+
+// checkCommitEvents makes sure that every repo has one commit event per successful write, and that the events for a
+// repo form an unbroken chain of strictly increasing revs, ending at the repo's current rev
+func checkCommitEvents(t *testing.T, s *Server, commits map[string]int) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	counts := make(map[string]int)
+	last := make(map[string]string)
+	if err := s.evtpersister.Playback(ctx, 0, func(evt *events.XRPCStreamEvent) error {
+		c := evt.RepoCommit
+		if c == nil {
+			return nil
+		}
+
+		if prev, ok := last[c.Repo]; ok {
+			if c.Rev <= prev {
+				t.Errorf("%s: rev %s is not after %s", c.Repo, c.Rev, prev)
+			}
+			if c.Since == nil || *c.Since != prev {
+				t.Errorf("%s: commit %s does not build on %s", c.Repo, c.Rev, prev)
+			}
+		}
+
+		last[c.Repo] = c.Rev
+		counts[c.Repo]++
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for did, n := range commits {
+		if counts[did] != n {
+			t.Errorf("%s: expected %d commit events, found %d", did, n, counts[did])
+		}
+
+		var rev string
+		if err := s.db.Raw(ctx, "SELECT rev FROM repos WHERE did = ?", nil, did).Scan(&rev).Error; err != nil {
+			t.Fatal(err)
+		}
+		if rev != last[did] {
+			t.Errorf("%s: repo is at rev %s but the last commit event is %s", did, rev, last[did])
+		}
+	}
+}
+
+func TestApplyWritesConcurrent(t *testing.T) {
+	const (
+		repos  = 4
+		writes = 25
+	)
+
+	s := newTestServer(t)
+
+	var urepos []models.Repo
+	for i := range repos {
+		urepos = append(urepos, createTestRepo(t, s, fmt.Sprintf("did:plc:test%d", i)))
+	}
+
+	// every repo gets written to by many goroutines at once, and all of the repos are written to at the same time
+	var wg sync.WaitGroup
+	errs := make(chan error, repos*writes)
+	for _, urepo := range urepos {
+		for i := range writes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// the repo is deliberately stale, like it would be after being loaded at the start of a request
+				if _, err := s.repoman.applyWrites(context.Background(), urepo, []Op{testPost(fmt.Sprintf("post%03d", i))}, nil); err != nil {
+					errs <- fmt.Errorf("%s: %w", urepo.Did, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	commits := make(map[string]int)
+	for _, urepo := range urepos {
+		rkeys := make(map[string]struct{})
+		for i := range writes {
+			rkeys[fmt.Sprintf("post%03d", i)] = struct{}{}
+		}
+
+		checkRepoRecords(t, s, urepo.Did, rkeys)
+		commits[urepo.Did] = writes
+	}
+
+	checkCommitEvents(t, s, commits)
+}
+
+func TestApplyWritesConcurrentWithoutLock(t *testing.T) {
+	const writes = 40
+
+	s := newTestServer(t)
+	urepo := createTestRepo(t, s, "did:plc:test")
+
+	// separate repo managers don't share repo locks, which is the same as two instances sharing a postgres database. some
+	// writes are expected to lose the race, but the ones that don't have to all end up in the repo
+	managers := []*RepoMan{NewRepoMan(s), NewRepoMan(s), NewRepoMan(s), NewRepoMan(s)}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ok  = make(map[string]struct{})
+		bad []error
+	)
+	for i := range writes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rkey := fmt.Sprintf("post%03d", i)
+			_, err := managers[i%len(managers)].applyWrites(context.Background(), urepo, []Op{testPost(rkey)}, nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err == nil {
+				ok[rkey] = struct{}{}
+			} else if !errors.Is(err, ErrConcurrentWrite) {
+				bad = append(bad, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range bad {
+		t.Error(err)
+	}
+
+	if len(ok) == 0 {
+		t.Fatal("expected at least one write to succeed")
+	}
+
+	checkRepoRecords(t, s, urepo.Did, ok)
+	checkCommitEvents(t, s, map[string]int{urepo.Did: len(ok)})
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -29,15 +30,20 @@ import (
 	"github.com/domodwyer/mailyak/v3"
 	"github.com/go-playground/validator"
 	"github.com/gorilla/sessions"
+	"github.com/haileyok/cocoon/blobstore"
+	"github.com/haileyok/cocoon/db_persister"
 	"github.com/haileyok/cocoon/identity"
+	"github.com/haileyok/cocoon/image_sanitizer"
 	"github.com/haileyok/cocoon/internal/db"
 	"github.com/haileyok/cocoon/internal/helpers"
+	"github.com/haileyok/cocoon/lexicons"
 	"github.com/haileyok/cocoon/models"
 	"github.com/haileyok/cocoon/oauth/client"
 	"github.com/haileyok/cocoon/oauth/constants"
 	"github.com/haileyok/cocoon/oauth/dpop"
 	"github.com/haileyok/cocoon/oauth/provider"
 	"github.com/haileyok/cocoon/plc"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
 	"github.com/ipfs/go-cid"
 	echo_session "github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -77,9 +83,39 @@ type Server struct {
 	repoman       *RepoMan
 	oauthProvider *provider.Provider
 	evtman        *events.EventManager
+	evtpersister  *db_persister.DbPersister
+	sequencer     *db_persister.Sequencer
 	passport      *identity.Passport
+	lexicons      *lexicons.Registry
+	blockCache    *sqlite_blockstore.BlockCache
+	blobstores    map[string]blobstore.Blobstore
+	blobStorage   string
+	blobGCGrace   time.Duration
+	blobLimits    *blobLimits
+	// imageOpts is only set when uploaded images should be sanitized
+	imageOpts     *image_sanitizer.Options
 	fallbackProxy string
 
+	// blobReconcileInterval is how often orphaned blob data gets cleaned up. zero disables it
+	blobReconcileInterval time.Duration
+	// blobSizesBackfilled is set once the sizes of blobs from before sizes were stored have been filled in
+	blobSizesBackfilled atomic.Bool
+
+	// imageSlots limits how many uploaded images are held in memory and decoded at the same time
+	imageSlots chan struct{}
+
+	// repoCompactInterval is how often repos get compacted. zero disables compaction
+	repoCompactInterval  time.Duration
+	repoHistoryRetention time.Duration
+
+	// importSpoolDir is where cars for import jobs are kept until they've been imported
+	importSpoolDir string
+	// importMaxSize is the largest car that can be imported
+	importMaxSize int64
+	importWake    chan struct{}
+	// importsRunning holds the progress of the import jobs that are being processed, by job id
+	importsRunning sync.Map
+
 	lastRequestCrawl time.Time
 	requestCrawlMu   sync.Mutex
 
@@ -116,7 +152,32 @@ type Args struct {
 	SessionSecret string
 
 	BlockstoreVariant BlockstoreVariant
-	FallbackProxy     string
+	// BlockCacheSize is the byte budget of the in memory block cache. zero disables it
+	BlockCacheSize int64
+	FallbackProxy  string
+
+	RepoCompactInterval  time.Duration
+	RepoHistoryRetention time.Duration
+
+	ImportSpoolDir string
+	ImportMaxSize  int64
+
+	EventsBackfillWindow time.Duration
+
+	LexiconDirs []string
+
+	DiskBlobstorePath string
+
+	BlobGCGracePeriod     time.Duration
+	BlobReconcileInterval time.Duration
+
+	BlobMaxSize    int64
+	BlobMimeLimits []string
+	BlobQuota      int64
+
+	BlobImageProcessing  bool
+	BlobImageMaxPixels   int64
+	BlobImageConcurrency int
 }
 
 type config struct {
@@ -321,6 +382,45 @@ func New(args *Args) (*Server, error) {
 	}
 	dbw := db.NewDB(gdb)
 
+	if args.EventsBackfillWindow == 0 {
+		args.EventsBackfillWindow = 72 * time.Hour
+	}
+	if args.BlobGCGracePeriod == 0 {
+		args.BlobGCGracePeriod = time.Hour
+	}
+
+	if args.BlobMaxSize == 0 {
+		args.BlobMaxSize = DefaultBlobMaxSize
+	}
+	if args.ImportMaxSize == 0 {
+		args.ImportMaxSize = DefaultImportMaxSize
+	}
+
+	mimeLimits, err := parseBlobMimeLimits(args.BlobMimeLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockCache *sqlite_blockstore.BlockCache
+	if args.BlockCacheSize > 0 {
+		blockCache = sqlite_blockstore.NewBlockCache(args.BlockCacheSize)
+	}
+
+	var imageOpts *image_sanitizer.Options
+	if args.BlobImageProcessing {
+		imageOpts = &image_sanitizer.Options{
+			MaxPixels: args.BlobImageMaxPixels,
+		}
+	}
+
+	sequencer := db_persister.NewSequencer(dbw)
+	evtpersister := db_persister.New(dbw, sequencer, args.EventsBackfillWindow)
+
+	lexreg, err := lexicons.NewRegistry(args.LexiconDirs)
+	if err != nil {
+		return nil, err
+	}
+
 	rkbytes, err := os.ReadFile(args.RotationKeyPath)
 	if err != nil {
 		return nil, err
@@ -387,8 +487,29 @@ func New(args *Args) (*Server, error) {
 			BlockstoreVariant: args.BlockstoreVariant,
 			FallbackProxy:     args.FallbackProxy,
 		},
-		evtman:   events.NewEventManager(events.NewMemPersister()),
-		passport: identity.NewPassport(h, identity.NewMemCache(10_000)),
+		evtman:       events.NewEventManager(evtpersister),
+		evtpersister: evtpersister,
+		sequencer:    sequencer,
+		passport:     identity.NewPassport(h, identity.NewMemCache(10_000)),
+		lexicons:     lexreg,
+		blockCache:   blockCache,
+		blobGCGrace:  args.BlobGCGracePeriod,
+		blobLimits: &blobLimits{
+			maxSize: args.BlobMaxSize,
+			mimes:   mimeLimits,
+			quota:   args.BlobQuota,
+		},
+		imageOpts:  imageOpts,
+		imageSlots: make(chan struct{}, max(args.BlobImageConcurrency, 1)),
+
+		blobReconcileInterval: args.BlobReconcileInterval,
+
+		repoCompactInterval:  args.RepoCompactInterval,
+		repoHistoryRetention: args.RepoHistoryRetention,
+
+		importSpoolDir: args.ImportSpoolDir,
+		importMaxSize:  args.ImportMaxSize,
+		importWake:     make(chan struct{}, 1),
 
 		dbName:   args.DbName,
 		dbType:   dbType,
@@ -418,6 +539,14 @@ func New(args *Args) (*Server, error) {
 
 	s.repoman = NewRepoMan(s) // TODO: this is way too lazy, stop it
 
+	if err := s.setupBlobstores(args); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(s.importSpoolDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating import spool directory: %w", err)
+	}
+
 	// TODO: should validate these args
 	if args.SmtpUser == "" || args.SmtpPass == "" || args.SmtpHost == "" || args.SmtpPort == "" || args.SmtpEmail == "" || args.SmtpName == "" {
 		args.Logger.Warn("not enough smtp args were provided. mailing will not work for your server.")
@@ -519,6 +648,9 @@ func (s *Server) addRoutes() {
 	s.echo.POST("/xrpc/com.atproto.repo.applyWrites", s.handleApplyWrites, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
 	s.echo.POST("/xrpc/com.atproto.repo.uploadBlob", s.handleRepoUploadBlob, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
 	s.echo.POST("/xrpc/com.atproto.repo.importRepo", s.handleRepoImportRepo, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
+	// import jobs aren't part of any lexicon, so they're kept out of /xrpc
+	s.echo.POST("/import/jobs", s.handleStartImportJob, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
+	s.echo.GET("/import/jobs/:id", s.handleGetImportJob, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
 
 	// stupid silly endpoints
 	s.echo.GET("/xrpc/app.bsky.actor.getPreferences", s.handleActorGetPreferences, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
@@ -528,6 +660,9 @@ func (s *Server) addRoutes() {
 	// admin routes
 	s.echo.POST("/xrpc/com.atproto.server.createInviteCode", s.handleCreateInviteCode, s.handleAdminMiddleware)
 	s.echo.POST("/xrpc/com.atproto.server.createInviteCodes", s.handleCreateInviteCodes, s.handleAdminMiddleware)
+	// like import jobs, these aren't part of any lexicon, so they're kept out of /xrpc
+	s.echo.GET("/admin/stats", s.handleStats, s.handleAdminMiddleware)
+	s.echo.GET("/admin/verify-repo", s.handleRepoVerify, s.handleAdminMiddleware)
 
 	// are there any routes that we should be allowing without auth? i dont think so but idk
 	s.echo.GET("/xrpc/*", s.handleProxy, s.handleLegacySessionMiddleware, s.handleOauthSessionMiddleware)
@@ -550,10 +685,22 @@ func (s *Server) Serve(ctx context.Context) error {
 		&models.Blob{},
 		&models.BlobPart{},
 		&models.ReservedKey{},
+		&models.Event{},
+		&models.EventSequence{},
+		&models.ImportJob{},
+		&models.ImportBlock{},
 		&provider.OauthToken{},
 		&provider.OauthAuthorizationRequest{},
 	)
 
+	if err := s.evtpersister.Init(ctx); err != nil {
+		return fmt.Errorf("error initializing event persister: %w", err)
+	}
+
+	if err := s.recoverImportJobs(ctx); err != nil {
+		return err
+	}
+
 	s.logger.Info("starting cocoon")
 
 	go func() {
@@ -564,6 +711,18 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	go s.backupRoutine()
 
+	go s.eventsPruneRoutine(ctx)
+
+	go s.blobGCRoutine(ctx)
+
+	go s.blobReconcileRoutine(ctx)
+
+	go s.backfillBlobSizes(ctx)
+
+	go s.repoCompactRoutine(ctx)
+
+	go s.importJobRoutine(ctx)
+
 	go func() {
 		if err := s.requestCrawl(ctx); err != nil {
 			s.logger.Error("error requesting crawls", "err", err)
@@ -644,17 +803,7 @@ func (s *Server) doBackup() {
 		currTime := time.Now().Format("2006-01-02_15-04-05")
 		key := "cocoon-backup-" + currTime + ".db"
 
-		config := &aws.Config{
-			Region:      aws.String(s.s3Config.Region),
-			Credentials: credentials.NewStaticCredentials(s.s3Config.AccessKey, s.s3Config.SecretKey, ""),
-		}
-
-		if s.s3Config.Endpoint != "" {
-			config.Endpoint = aws.String(s.s3Config.Endpoint)
-			config.S3ForcePathStyle = aws.Bool(true)
-		}
-
-		sess, err := session.NewSession(config)
+		sess, err := s.newS3Session()
 		if err != nil {
 			return err
 		}
@@ -728,10 +877,84 @@ func (s *Server) backupRoutine() {
 	}
 }
 
-func (s *Server) UpdateRepo(ctx context.Context, did string, root cid.Cid, rev string) error {
-	if err := s.db.Exec(ctx, "UPDATE repos SET root = ?, rev = ? WHERE did = ?", nil, root.Bytes(), rev, did).Error; err != nil {
+func (s *Server) eventsPruneRoutine(ctx context.Context) {
+	logger := s.logger.With("component", "events-prune")
+
+	prune := func() {
+		n, err := s.evtpersister.Prune(ctx)
+		if err != nil {
+			logger.Error("error pruning events", "err", err)
+			return
+		}
+		logger.Info("pruned events outside of backfill window", "count", n)
+	}
+
+	prune()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			prune()
+		}
+	}
+}
+
+func (s *Server) UpdateRepo(ctx context.Context, tx *db.DB, did string, root cid.Cid, rev string) error {
+	if err := tx.Exec(ctx, "UPDATE repos SET root = ?, rev = ? WHERE did = ?", nil, root.Bytes(), rev, did).Error; err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (s *Server) newS3Session() (*session.Session, error) {
+	return NewS3Session(s.s3Config)
+}
+
+func NewS3Session(cfg *S3Config) (*session.Session, error) {
+	config := &aws.Config{
+		Region:      aws.String(cfg.Region),
+		Credentials: credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""),
+	}
+
+	if cfg.Endpoint != "" {
+		config.Endpoint = aws.String(cfg.Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	return session.NewSession(config)
+}
+
+// setupBlobstores creates every blobstore that has been configured, and picks the one new blobs get written to. blobs
+// are always read from whichever store their row says they're in, so older blobs keep working after switching
+func (s *Server) setupBlobstores(args *Args) error {
+	s.blobstores = map[string]blobstore.Blobstore{
+		blobstore.StorageSqlite: blobstore.NewSqlite(s.db),
+	}
+	s.blobStorage = blobstore.StorageSqlite
+
+	if args.DiskBlobstorePath != "" {
+		bs, err := blobstore.NewDisk(args.DiskBlobstorePath)
+		if err != nil {
+			return err
+		}
+		s.blobstores[blobstore.StorageDisk] = bs
+		s.blobStorage = blobstore.StorageDisk
+	}
+
+	if s.s3Config != nil && s.s3Config.BlobstoreEnabled {
+		sess, err := s.newS3Session()
+		if err != nil {
+			return fmt.Errorf("error creating aws session: %w", err)
+		}
+		s.blobstores[blobstore.StorageS3] = blobstore.NewS3(s3.New(sess), s.s3Config.Bucket)
+		s.blobStorage = blobstore.StorageS3
+	}
+
+	return nil
+}
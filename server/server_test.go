@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/haileyok/cocoon/db_persister"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/lexicons"
+	"github.com/haileyok/cocoon/models"
+	"github.com/haileyok/cocoon/recording_blockstore"
+	"github.com/haileyok/cocoon/sqlite_blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestServer sets up just enough of a server to apply writes against a temporary sqlite database
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	gdb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "cocoon.db")+"?_busy_timeout=5000"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbw := db.NewDB(gdb)
+	if err := dbw.AutoMigrate(
+		&models.Actor{},
+		&models.Repo{},
+		&models.Block{},
+		&models.Record{},
+		&models.Blob{},
+		&models.BlobPart{},
+		&models.Event{},
+		&models.EventSequence{},
+		&models.ImportJob{},
+		&models.ImportBlock{},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	sequencer := db_persister.NewSequencer(dbw)
+	persister := db_persister.New(dbw, sequencer, time.Hour)
+	if err := persister.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lexreg, err := lexicons.NewRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		db:           dbw,
+		logger:       slog.New(slog.DiscardHandler),
+		config:       &config{},
+		evtman:       events.NewEventManager(persister),
+		evtpersister: persister,
+		sequencer:    sequencer,
+		lexicons:     lexreg,
+		blobLimits:   &blobLimits{maxSize: DefaultBlobMaxSize},
+		blockCache:   sqlite_blockstore.NewBlockCache(1 << 20),
+		imageSlots:   make(chan struct{}, DefaultBlobImageConcurrency),
+	}
+	s.repoman = NewRepoMan(s)
+
+	if err := s.setupBlobstores(&Args{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// createTestRepo creates an account with an empty repo, the same way createAccount does
+func createTestRepo(t *testing.T, s *Server, did string) models.Repo {
+	t.Helper()
+
+	ctx := context.Background()
+
+	k, err := atcrypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urepo := models.Repo{
+		Did:        did,
+		Email:      did + "@example.com",
+		SigningKey: k.Bytes(),
+	}
+	if err := s.db.Create(ctx, &urepo, nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	bs := recording_blockstore.New(s.getReadOnlyBlockstore(did))
+	r := repo.NewRepo(ctx, did, bs)
+
+	root, rev, err := r.Commit(ctx, urepo.SignFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.db.Transaction(ctx, func(tx *db.DB) error {
+		newblocks := make([]blocks.Block, 0, len(bs.GetWriteLog()))
+		for _, blk := range bs.GetWriteLog() {
+			newblocks = append(newblocks, blk)
+		}
+
+		if err := s.getTxBlockstore(tx, did, rev).PutMany(ctx, newblocks); err != nil {
+			return err
+		}
+
+		return s.UpdateRepo(ctx, tx, did, root, rev)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	urepo.Root = root.Bytes()
+	urepo.Rev = rev
+
+	return urepo
+}
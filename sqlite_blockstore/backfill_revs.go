@@ -0,0 +1,210 @@
+package sqlite_blockstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/bluesky-social/indigo/mst"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	backfillBatchSize = 500
+)
+
+type commitRef struct {
+	cid cid.Cid
+	rev string
+}
+
+type BackfillRevsResult struct {
+	Commits int
+	Updated int
+	Orphans int
+}
+
+// BackfillRevs rederives the rev of every block in a repo. older versions of cocoon tagged blocks with the time they
+// were written instead of the rev of the commit that wrote them. old commit blocks stick around until the repo is
+// compacted, so we can find every commit in the repo, walk them from oldest to newest, and tag each block with the last
+// commit that reaches it without its previous commit also reaching it. that is the same rev that it would have gotten
+// when it was written, including blocks that were removed and later added back. blocks that no commit reaches are left
+// alone and counted as orphans
+func BackfillRevs(ctx context.Context, dbw *db.DB, did string) (*BackfillRevsResult, error) {
+	commits, total, err := findCommits(ctx, dbw, did)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &BackfillRevsResult{
+		Commits: len(commits),
+	}
+
+	bs := NewReadOnly(did, dbw)
+
+	// links caches what every commit and mst node that we've decoded points at. consecutive commits share most of their
+	// tree, so this means we only have to read the blocks that each commit actually added
+	links := map[cid.Cid][]blockLink{}
+	updated := map[cid.Cid]struct{}{}
+
+	var prev map[cid.Cid]struct{}
+	for _, commit := range commits {
+		reached, err := reachableBlocks(ctx, bs, commit.cid, links)
+		if err != nil {
+			return nil, fmt.Errorf("error walking commit %s: %w", commit.cid, err)
+		}
+
+		if err := dbw.Transaction(ctx, func(tx *db.DB) error {
+			for c := range reached {
+				if _, ok := prev[c]; ok {
+					continue
+				}
+
+				r := tx.Exec(ctx, "UPDATE blocks SET rev = ? WHERE did = ? AND cid = ?", nil, commit.rev, did, c.Bytes())
+				if r.Error != nil {
+					return r.Error
+				}
+				if r.RowsAffected > 0 {
+					updated[c] = struct{}{}
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("error updating revs for commit %s: %w", commit.cid, err)
+		}
+
+		prev = reached
+	}
+
+	res.Updated = len(updated)
+	res.Orphans = total - res.Updated
+
+	return res, nil
+}
+
+type blockLink struct {
+	cid  cid.Cid
+	node bool
+}
+
+// reachableBlocks returns the cid of every block that is reachable from the commit at root. records aren't read, since
+// there's nothing below them
+func reachableBlocks(ctx context.Context, bs *SqliteBlockstore, root cid.Cid, links map[cid.Cid][]blockLink) (map[cid.Cid]struct{}, error) {
+	reached := map[cid.Cid]struct{}{root: {}}
+
+	commitLinks, ok := links[root]
+	if !ok {
+		blk, err := bs.Get(ctx, root)
+		if err != nil {
+			return nil, fmt.Errorf("error getting commit block %s: %w", root, err)
+		}
+
+		var sc repo.SignedCommit
+		if err := sc.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+			return nil, fmt.Errorf("error decoding commit block %s: %w", root, err)
+		}
+
+		commitLinks = []blockLink{{cid: sc.Data, node: true}}
+		links[root] = commitLinks
+	}
+
+	queue := append([]blockLink(nil), commitLinks...)
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		l := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		if _, ok := reached[l.cid]; ok {
+			continue
+		}
+		reached[l.cid] = struct{}{}
+
+		if !l.node {
+			continue
+		}
+
+		nodeLinks, ok := links[l.cid]
+		if !ok {
+			blk, err := bs.Get(ctx, l.cid)
+			if err != nil {
+				return nil, fmt.Errorf("error getting mst node %s: %w", l.cid, err)
+			}
+
+			var nd mst.NodeData
+			if err := nd.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+				return nil, fmt.Errorf("error decoding mst node %s: %w", l.cid, err)
+			}
+
+			if nd.Left != nil {
+				nodeLinks = append(nodeLinks, blockLink{cid: *nd.Left, node: true})
+			}
+			for _, e := range nd.Entries {
+				nodeLinks = append(nodeLinks, blockLink{cid: e.Val})
+				if e.Tree != nil {
+					nodeLinks = append(nodeLinks, blockLink{cid: *e.Tree, node: true})
+				}
+			}
+			links[l.cid] = nodeLinks
+		}
+
+		queue = append(queue, nodeLinks...)
+	}
+
+	return reached, nil
+}
+
+// findCommits finds every commit block in a repo by scanning all of its blocks, and returns them sorted from oldest to
+// newest along with the total number of blocks in the repo
+func findCommits(ctx context.Context, dbw *db.DB, did string) ([]commitRef, int, error) {
+	var commits []commitRef
+	total := 0
+
+	last := []byte{}
+	for {
+		var rows []struct {
+			Cid   []byte
+			Value []byte
+		}
+		if err := dbw.Raw(ctx, "SELECT cid, value FROM blocks WHERE did = ? AND cid > ? ORDER BY cid ASC LIMIT ?", nil, did, last, backfillBatchSize).Scan(&rows).Error; err != nil {
+			return nil, 0, fmt.Errorf("error getting blocks: %w", err)
+		}
+
+		for _, row := range rows {
+			total++
+
+			// most blocks aren't commits, so just skip over anything that doesn't decode as one
+			var sc repo.SignedCommit
+			if err := sc.UnmarshalCBOR(bytes.NewReader(row.Value)); err != nil {
+				continue
+			}
+			if sc.Did != did || sc.Rev == "" || len(sc.Sig) == 0 || !sc.Data.Defined() {
+				continue
+			}
+
+			c, err := cid.Cast(row.Cid)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error parsing block cid: %w", err)
+			}
+
+			commits = append(commits, commitRef{cid: c, rev: sc.Rev})
+		}
+
+		if len(rows) < backfillBatchSize {
+			break
+		}
+		last = rows[len(rows)-1].Cid
+	}
+
+	// revs are tids, so sorting them as strings puts them in commit order
+	sort.Slice(commits, func(i, j int) bool {
+		return commits[i].rev < commits[j].rev
+	})
+
+	return commits, total, nil
+}
@@ -0,0 +1,149 @@
+package sqlite_blockstore
+
+import (
+	"container/list"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// DefaultCacheSize is the default byte budget of the block cache
+	DefaultCacheSize = 64 << 20
+
+	// cacheEntryOverhead is roughly what an entry costs on top of its block data, for the key, list element and map entry
+	cacheEntryOverhead = 128
+)
+
+// BlockCache is an lru cache of blocks that is shared by every repo. blocks are content addressed and never change, so
+// a cached block can't go stale, it can only be deleted. entries are still keyed by did, so that a repo can never read
+// a block that only exists in another repo
+type BlockCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[blockCacheKey]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type blockCacheKey struct {
+	did string
+	cid string
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	block blocks.Block
+	size  int64
+}
+
+type BlockCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+}
+
+func NewBlockCache(maxBytes int64) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    map[blockCacheKey]*list.Element{},
+	}
+}
+
+func (c *BlockCache) Get(did string, k cid.Cid) (blocks.Block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[blockCacheKey{did: did, cid: k.KeyString()}]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*blockCacheEntry).block, true
+}
+
+func (c *BlockCache) Add(did string, b blocks.Block) {
+	size := int64(len(b.RawData()) + len(did) + cacheEntryOverhead)
+
+	// a block that could never fit would just flush everything else out
+	if size > c.maxBytes {
+		return
+	}
+
+	key := blockCacheKey{did: did, cid: b.Cid().KeyString()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&blockCacheEntry{
+		key:   key,
+		block: b,
+		size:  size,
+	})
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+}
+
+func (c *BlockCache) Remove(did string, k cid.Cid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[blockCacheKey{did: did, cid: k.KeyString()}]; ok {
+		c.removeElement(el)
+	}
+}
+
+// RemoveRepo removes every cached block of a repo. this has to look at every entry in the cache, so it should only be
+// used when a repo's blocks are being replaced wholesale
+func (c *BlockCache) RemoveRepo(did string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.items {
+		if key.did == did {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return BlockCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+func (c *BlockCache) removeElement(el *list.Element) {
+	entry := el.Value.(*blockCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
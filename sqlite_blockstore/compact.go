@@ -0,0 +1,133 @@
+package sqlite_blockstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/internal/repowalk"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	compactBatchSize = 500
+)
+
+type CompactArgs struct {
+	Did  string
+	Root cid.Cid
+	// KeepSince is a rev to keep history back to. every commit that was still the head of the repo at or after it is
+	// kept, along with everything it reaches. if it isn't set, only what the current root reaches is kept
+	KeepSince string
+	// Cache is the block cache that deleted blocks get removed from, if there is one
+	Cache  *BlockCache
+	DryRun bool
+}
+
+type CompactResult struct {
+	Commits   int
+	Reachable int
+	Deleted   int
+	Bytes     int64
+}
+
+// Compact deletes every block in a repo that is no longer reachable from its root. every write leaves behind the old
+// commit block and mst nodes that it replaced, so without this the blocks table only ever grows. nothing else can be
+// writing to the repo while this runs, since a commit could pick an unreachable block back up right as we delete it
+func Compact(ctx context.Context, dbw *db.DB, args CompactArgs) (*CompactResult, error) {
+	roots := []cid.Cid{args.Root}
+
+	if args.KeepSince != "" {
+		commits, _, err := findCommits(ctx, dbw, args.Did)
+		if err != nil {
+			return nil, err
+		}
+
+		// commits are sorted oldest first. the newest commit from before the cutoff was still the head at the cutoff, so
+		// it gets kept too
+		for i, commit := range commits {
+			if commit.rev >= args.KeepSince || (i+1 < len(commits) && commits[i+1].rev >= args.KeepSince) {
+				roots = append(roots, commit.cid)
+			}
+		}
+	}
+
+	// mark everything that is reachable. if any block is missing we bail, since deleting based on a partial walk would
+	// take out blocks that are still in use
+	reachable := map[string]struct{}{}
+	bs := NewReadOnly(args.Did, dbw)
+
+	res := &CompactResult{}
+	for _, root := range roots {
+		if _, ok := reachable[root.KeyString()]; ok {
+			continue
+		}
+		res.Commits++
+
+		if err := repowalk.Walk(ctx, bs, root, func(c cid.Cid) bool {
+			_, ok := reachable[c.KeyString()]
+			return ok
+		}, func(blk blocks.Block) error {
+			reachable[blk.Cid().KeyString()] = struct{}{}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("error walking commit %s: %w", root, err)
+		}
+	}
+	res.Reachable = len(reachable)
+
+	// then sweep everything else
+	var unreachable [][]byte
+	last := []byte{}
+	for {
+		var rows []struct {
+			Cid  []byte
+			Size int64
+		}
+		if err := dbw.Raw(ctx, "SELECT cid, LENGTH(value) AS size FROM blocks WHERE did = ? AND cid > ? ORDER BY cid ASC LIMIT ?", nil, args.Did, last, compactBatchSize).Scan(&rows).Error; err != nil {
+			return nil, fmt.Errorf("error getting blocks: %w", err)
+		}
+
+		for _, row := range rows {
+			if _, ok := reachable[string(row.Cid)]; ok {
+				continue
+			}
+
+			unreachable = append(unreachable, row.Cid)
+			res.Bytes += row.Size
+		}
+
+		if len(rows) < compactBatchSize {
+			break
+		}
+		last = rows[len(rows)-1].Cid
+	}
+
+	if args.DryRun {
+		res.Deleted = len(unreachable)
+		return res, nil
+	}
+
+	for len(unreachable) > 0 {
+		n := min(len(unreachable), compactBatchSize)
+		batch := unreachable[:n]
+		unreachable = unreachable[n:]
+
+		if err := dbw.Exec(ctx, "DELETE FROM blocks WHERE did = ? AND cid IN ?", nil, args.Did, batch).Error; err != nil {
+			return nil, fmt.Errorf("error deleting blocks: %w", err)
+		}
+
+		if args.Cache != nil {
+			for _, b := range batch {
+				if c, err := cid.Cast(b); err == nil {
+					args.Cache.Remove(args.Did, c)
+				}
+			}
+		}
+
+		res.Deleted += n
+	}
+
+	return res, nil
+}
@@ -2,21 +2,32 @@ package sqlite_blockstore
 
 import (
 	"context"
-	"fmt"
+	"errors"
 
-	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/haileyok/cocoon/internal/db"
 	"github.com/haileyok/cocoon/models"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	"gorm.io/gorm/clause"
 )
 
+// ErrNoRev is returned when writing blocks before the blockstore's rev has been set
+var ErrNoRev = errors.New("blockstore rev must be set before writing blocks")
+
+const (
+	allKeysBatchSize = 1000
+)
+
 type SqliteBlockstore struct {
-	db       *db.DB
-	did      string
-	readonly bool
-	inserts  map[cid.Cid]blocks.Block
+	db         *db.DB
+	did        string
+	rev        string
+	readonly   bool
+	hashOnRead bool
+	inserts    map[cid.Cid]blocks.Block
+	cache      *BlockCache
+	fillCache  bool
 }
 
 func New(did string, db *db.DB) *SqliteBlockstore {
@@ -37,6 +48,20 @@ func NewReadOnly(did string, db *db.DB) *SqliteBlockstore {
 	}
 }
 
+// SetCache puts a shared block cache in front of the database. reads always check the cache, but blocks are only added
+// to it when fill is set. a blockstore that reads through a transaction shouldn't fill it, since the blocks it reads
+// might have been written in that transaction and could still get rolled back
+func (bs *SqliteBlockstore) SetCache(cache *BlockCache, fill bool) {
+	bs.cache = cache
+	bs.fillCache = fill
+}
+
+// SetRev sets the rev that blocks get tagged with when they're written. this should be the rev of the commit that the
+// blocks are a part of, and it needs to be set before writing to a blockstore that isn't read only
+func (bs *SqliteBlockstore) SetRev(rev string) {
+	bs.rev = rev
+}
+
 func (bs *SqliteBlockstore) Get(ctx context.Context, cid cid.Cid) (blocks.Block, error) {
 	var block models.Block
 
@@ -45,8 +70,30 @@ func (bs *SqliteBlockstore) Get(ctx context.Context, cid cid.Cid) (blocks.Block,
 		return maybeBlock, nil
 	}
 
-	if err := bs.db.Raw(ctx, "SELECT * FROM blocks WHERE did = ? AND cid = ?", nil, bs.did, cid.Bytes()).Scan(&block).Error; err != nil {
-		return nil, err
+	if bs.cache != nil {
+		if b, ok := bs.cache.Get(bs.did, cid); ok {
+			return b, nil
+		}
+	}
+
+	res := bs.db.Raw(ctx, "SELECT * FROM blocks WHERE did = ? AND cid = ?", nil, bs.did, cid.Bytes()).Scan(&block)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, ipld.ErrNotFound{Cid: cid}
+	}
+
+	if bs.hashOnRead {
+		rc, err := cid.Prefix().Sum(block.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if !rc.Equals(cid) {
+			return nil, blocks.ErrWrongHash
+		}
 	}
 
 	b, err := blocks.NewBlockWithCid(block.Value, cid)
@@ -54,6 +101,10 @@ func (bs *SqliteBlockstore) Get(ctx context.Context, cid cid.Cid) (blocks.Block,
 		return nil, err
 	}
 
+	if bs.cache != nil && bs.fillCache {
+		bs.cache.Add(bs.did, b)
+	}
+
 	return b, nil
 }
 
@@ -64,16 +115,23 @@ func (bs *SqliteBlockstore) Put(ctx context.Context, block blocks.Block) error {
 		return nil
 	}
 
+	if bs.rev == "" {
+		return ErrNoRev
+	}
+
 	b := models.Block{
 		Did:   bs.did,
 		Cid:   block.Cid().Bytes(),
-		Rev:   syntax.NewTIDNow(0).String(), // TODO: WARN, this is bad. don't do this
+		Rev:   bs.rev,
 		Value: block.RawData(),
 	}
 
+	// blocks are content addressed, so if we already have this one only the rev needs to change. a block that gets
+	// written again was added back to the repo by this commit (e.g. a record that was deleted and then created again), so
+	// getRepo with a since after the old rev has to send it
 	if err := bs.db.Create(ctx, &b, []clause.Expression{clause.OnConflict{
 		Columns:   []clause.Column{{Name: "did"}, {Name: "cid"}},
-		UpdateAll: true,
+		DoUpdates: clause.AssignmentColumns([]string{"rev"}),
 	}}).Error; err != nil {
 		return err
 	}
@@ -81,57 +139,162 @@ func (bs *SqliteBlockstore) Put(ctx context.Context, block blocks.Block) error {
 	return nil
 }
 
-func (bs *SqliteBlockstore) DeleteBlock(context.Context, cid.Cid) error {
-	panic("not implemented")
-}
+func (bs *SqliteBlockstore) DeleteBlock(ctx context.Context, cid cid.Cid) error {
+	delete(bs.inserts, cid)
 
-func (bs *SqliteBlockstore) Has(context.Context, cid.Cid) (bool, error) {
-	panic("not implemented")
-}
+	if bs.readonly {
+		return nil
+	}
 
-func (bs *SqliteBlockstore) GetSize(context.Context, cid.Cid) (int, error) {
-	panic("not implemented")
-}
+	if bs.cache != nil {
+		bs.cache.Remove(bs.did, cid)
+	}
 
-func (bs *SqliteBlockstore) PutMany(ctx context.Context, blocks []blocks.Block) error {
-	tx := bs.db.BeginDangerously(ctx)
+	return bs.db.Exec(ctx, "DELETE FROM blocks WHERE did = ? AND cid = ?", nil, bs.did, cid.Bytes()).Error
+}
 
-	for _, block := range blocks {
-		bs.inserts[block.Cid()] = block
+func (bs *SqliteBlockstore) Has(ctx context.Context, cid cid.Cid) (bool, error) {
+	if _, ok := bs.inserts[cid]; ok {
+		return true, nil
+	}
 
-		if bs.readonly {
-			continue
+	if bs.cache != nil {
+		if _, ok := bs.cache.Get(bs.did, cid); ok {
+			return true, nil
 		}
+	}
 
-		b := models.Block{
-			Did:   bs.did,
-			Cid:   block.Cid().Bytes(),
-			Rev:   syntax.NewTIDNow(0).String(), // TODO: WARN, this is bad. don't do this
-			Value: block.RawData(),
-		}
+	var count int64
+	if err := bs.db.Raw(ctx, "SELECT COUNT(*) FROM blocks WHERE did = ? AND cid = ?", nil, bs.did, cid.Bytes()).Scan(&count).Error; err != nil {
+		return false, err
+	}
 
-		if err := tx.Clauses(clause.OnConflict{
-			Columns:   []clause.Column{{Name: "did"}, {Name: "cid"}},
-			UpdateAll: true,
-		}).Create(&b).Error; err != nil {
-			tx.Rollback()
-			return err
+	return count > 0, nil
+}
+
+func (bs *SqliteBlockstore) GetSize(ctx context.Context, cid cid.Cid) (int, error) {
+	if b, ok := bs.inserts[cid]; ok {
+		return len(b.RawData()), nil
+	}
+
+	if bs.cache != nil {
+		if b, ok := bs.cache.Get(bs.did, cid); ok {
+			return len(b.RawData()), nil
 		}
 	}
 
+	var sizes []int
+	if err := bs.db.Raw(ctx, "SELECT LENGTH(value) FROM blocks WHERE did = ? AND cid = ?", nil, bs.did, cid.Bytes()).Scan(&sizes).Error; err != nil {
+		return 0, err
+	}
+
+	if len(sizes) == 0 {
+		return 0, ipld.ErrNotFound{Cid: cid}
+	}
+
+	return sizes[0], nil
+}
+
+func (bs *SqliteBlockstore) PutMany(ctx context.Context, blocks []blocks.Block) error {
+	for _, block := range blocks {
+		bs.inserts[block.Cid()] = block
+	}
+
 	if bs.readonly {
 		return nil
 	}
 
-	tx.Commit()
+	if bs.rev == "" {
+		return ErrNoRev
+	}
+
+	return bs.db.Transaction(ctx, func(tx *db.DB) error {
+		for _, block := range blocks {
+			b := models.Block{
+				Did:   bs.did,
+				Cid:   block.Cid().Bytes(),
+				Rev:   bs.rev,
+				Value: block.RawData(),
+			}
 
-	return nil
+			// same as in Put, an existing block gets tagged with the rev that wrote it again
+			if err := tx.Create(ctx, &b, []clause.Expression{clause.OnConflict{
+				Columns:   []clause.Column{{Name: "did"}, {Name: "cid"}},
+				DoUpdates: clause.AssignmentColumns([]string{"rev"}),
+			}}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
+// AllKeysChan streams the cid of every block in the repo, including any that have only been written in memory. blocks
+// are read from the database in batches, and the channel is closed once they've all been sent or ctx is cancelled
 func (bs *SqliteBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
-	return nil, fmt.Errorf("iteration not allowed on sqlite blockstore")
+	// the in memory blocks are copied now, since the map isn't safe to read while the blockstore keeps getting used
+	pending := make([]cid.Cid, 0, len(bs.inserts))
+	for c := range bs.inserts {
+		pending = append(pending, c)
+	}
+
+	ch := make(chan cid.Cid)
+
+	go func() {
+		defer close(ch)
+
+		send := func(c cid.Cid) bool {
+			select {
+			case ch <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		seen := make(map[cid.Cid]struct{}, len(pending))
+		for _, c := range pending {
+			seen[c] = struct{}{}
+			if !send(c) {
+				return
+			}
+		}
+
+		last := []byte{}
+		for {
+			var cids [][]byte
+			if err := bs.db.Raw(ctx, "SELECT cid FROM blocks WHERE did = ? AND cid > ? ORDER BY cid ASC LIMIT ?", nil, bs.did, last, allKeysBatchSize).Scan(&cids).Error; err != nil {
+				// there's no way to hand back an error from here, so all we can do is stop early
+				return
+			}
+
+			for _, b := range cids {
+				last = b
+
+				c, err := cid.Cast(b)
+				if err != nil {
+					continue
+				}
+
+				if _, ok := seen[c]; ok {
+					continue
+				}
+
+				if !send(c) {
+					return
+				}
+			}
+
+			if len(cids) < allKeysBatchSize {
+				return
+			}
+		}
+	}()
+
+	return ch, nil
 }
 
 func (bs *SqliteBlockstore) HashOnRead(enabled bool) {
-	panic("not implemented")
+	bs.hashOnRead = enabled
 }
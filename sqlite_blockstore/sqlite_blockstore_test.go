@@ -0,0 +1,658 @@
+package sqlite_blockstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/haileyok/cocoon/internal/db"
+	"github.com/haileyok/cocoon/models"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testDid = "did:plc:test"
+	testRev = "3jzfcijpj2z2a"
+)
+
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+
+	gdb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "cocoon.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbw := db.NewDB(gdb)
+	if err := dbw.AutoMigrate(&models.Block{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return dbw
+}
+
+func testBlocks(n int) []blocks.Block {
+	blks := make([]blocks.Block, 0, n)
+	for i := range n {
+		blks = append(blks, blocks.NewBlock(fmt.Appendf(nil, "block %d", i)))
+	}
+	return blks
+}
+
+func blockRev(t *testing.T, dbw *db.DB, did string, c cid.Cid) string {
+	t.Helper()
+
+	var revs []string
+	if err := dbw.Raw(context.Background(), "SELECT rev FROM blocks WHERE did = ? AND cid = ?", nil, did, c.Bytes()).Scan(&revs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 {
+		t.Fatalf("expected one row for %s, found %d", c, len(revs))
+	}
+
+	return revs[0]
+}
+
+func collectKeys(t *testing.T, bs blockstore.Blockstore) map[cid.Cid]int {
+	t.Helper()
+
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[cid.Cid]int{}
+	for c := range ch {
+		keys[c]++
+	}
+
+	return keys
+}
+
+// runBlockstoreSuite checks that a blockstore behaves like any other blockstore would. newStore returns an empty
+// blockstore that can be written to
+func runBlockstoreSuite(t *testing.T, newStore func(t *testing.T) blockstore.Blockstore) {
+	ctx := context.Background()
+
+	blk := testBlocks(1)[0]
+	missing := blocks.NewBlock([]byte("missing"))
+
+	t.Run("put and get", func(t *testing.T) {
+		bs := newStore(t)
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := bs.Get(ctx, blk.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Cid().Equals(blk.Cid()) || string(got.RawData()) != string(blk.RawData()) {
+			t.Errorf("got a different block back")
+		}
+	})
+
+	t.Run("has and get size", func(t *testing.T) {
+		bs := newStore(t)
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		has, err := bs.Has(ctx, blk.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			t.Errorf("expected block to exist")
+		}
+
+		size, err := bs.GetSize(ctx, blk.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(blk.RawData()) {
+			t.Errorf("expected size %d, got %d", len(blk.RawData()), size)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		bs := newStore(t)
+
+		if _, err := bs.Get(ctx, missing.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected not found from get, got %v", err)
+		}
+
+		if _, err := bs.GetSize(ctx, missing.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected not found from get size, got %v", err)
+		}
+
+		has, err := bs.Has(ctx, missing.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			t.Errorf("expected missing block to not exist")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		bs := newStore(t)
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bs.DeleteBlock(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bs.Get(ctx, blk.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected deleted block to not be found, got %v", err)
+		}
+		if has, err := bs.Has(ctx, blk.Cid()); err != nil || has {
+			t.Errorf("expected deleted block to not exist, got %v (err: %v)", has, err)
+		}
+	})
+
+	t.Run("put many", func(t *testing.T) {
+		bs := newStore(t)
+
+		blks := testBlocks(10)
+		if err := bs.PutMany(ctx, blks); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range blks {
+			if _, err := bs.Get(ctx, b.Cid()); err != nil {
+				t.Errorf("error getting %s: %v", b.Cid(), err)
+			}
+		}
+	})
+
+	t.Run("writing a block again", func(t *testing.T) {
+		bs := newStore(t)
+
+		for range 2 {
+			if err := bs.Put(ctx, blk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bs.PutMany(ctx, []blocks.Block{blk}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bs.Get(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+		if keys := collectKeys(t, bs); len(keys) != 1 || keys[blk.Cid()] != 1 {
+			t.Errorf("expected the block to be sent once, got %v", keys)
+		}
+	})
+
+	t.Run("all keys", func(t *testing.T) {
+		bs := newStore(t)
+
+		// more than a single batch, so that paging through the database gets used
+		blks := testBlocks(allKeysBatchSize*2 + 10)
+		if err := bs.PutMany(ctx, blks); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := collectKeys(t, bs)
+		if len(keys) != len(blks) {
+			t.Errorf("expected %d keys, got %d", len(blks), len(keys))
+		}
+		for _, b := range blks {
+			if keys[b.Cid()] != 1 {
+				t.Errorf("expected %s to be sent once, was sent %d times", b.Cid(), keys[b.Cid()])
+			}
+		}
+	})
+
+	t.Run("all keys stops when cancelled", func(t *testing.T) {
+		bs := newStore(t)
+
+		if err := bs.PutMany(ctx, testBlocks(10)); err != nil {
+			t.Fatal(err)
+		}
+
+		cctx, cancel := context.WithCancel(ctx)
+		ch, err := bs.AllKeysChan(cctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		<-ch
+		cancel()
+
+		// the channel has to get closed, otherwise this never returns
+		for range ch {
+		}
+	})
+}
+
+func TestBlockstore(t *testing.T) {
+	variants := []struct {
+		name     string
+		newStore func(t *testing.T) blockstore.Blockstore
+	}{
+		{
+			name: "read write",
+			newStore: func(t *testing.T) blockstore.Blockstore {
+				bs := New(testDid, newTestDB(t))
+				bs.SetRev(testRev)
+				return bs
+			},
+		},
+		{
+			name: "read only",
+			newStore: func(t *testing.T) blockstore.Blockstore {
+				return NewReadOnly(testDid, newTestDB(t))
+			},
+		},
+		{
+			name: "cached",
+			newStore: func(t *testing.T) blockstore.Blockstore {
+				bs := New(testDid, newTestDB(t))
+				bs.SetRev(testRev)
+				bs.SetCache(NewBlockCache(DefaultCacheSize), true)
+				return bs
+			},
+		},
+		{
+			// the way blockstores are set up inside a transaction
+			name: "cached without filling",
+			newStore: func(t *testing.T) blockstore.Blockstore {
+				bs := New(testDid, newTestDB(t))
+				bs.SetRev(testRev)
+				bs.SetCache(NewBlockCache(DefaultCacheSize), false)
+				return bs
+			},
+		},
+		{
+			name: "cached read only",
+			newStore: func(t *testing.T) blockstore.Blockstore {
+				bs := NewReadOnly(testDid, newTestDB(t))
+				bs.SetCache(NewBlockCache(DefaultCacheSize), true)
+				return bs
+			},
+		},
+	}
+
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) {
+			runBlockstoreSuite(t, v.newStore)
+		})
+	}
+}
+
+// TestBlockstoreDatabase covers what the suite can't see from a single blockstore, like what actually ends up in the
+// database
+func TestBlockstoreDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	blk := testBlocks(1)[0]
+	missing := blocks.NewBlock([]byte("missing"))
+
+	t.Run("blocks are read back from the database", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+
+		blks := testBlocks(10)
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.PutMany(ctx, blks); err != nil {
+			t.Fatal(err)
+		}
+
+		// a fresh blockstore has nothing in memory, so these have to come from the database
+		fresh := New(testDid, dbw)
+		for _, b := range append(blks, blk) {
+			got, err := fresh.Get(ctx, b.Cid())
+			if err != nil {
+				t.Fatalf("error getting %s: %v", b.Cid(), err)
+			}
+			if string(got.RawData()) != string(b.RawData()) {
+				t.Errorf("got a different block back for %s", b.Cid())
+			}
+		}
+
+		size, err := fresh.GetSize(ctx, blk.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != len(blk.RawData()) {
+			t.Errorf("expected size %d, got %d", len(blk.RawData()), size)
+		}
+	})
+
+	t.Run("blocks are scoped to their repo", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := New("did:plc:other", dbw).Get(ctx, blk.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected another repo's block to not be found, got %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bs.DeleteBlock(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := New(testDid, dbw).Get(ctx, blk.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected deleted block to be gone from the database, got %v", err)
+		}
+	})
+
+	t.Run("all keys", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+
+		blks := testBlocks(allKeysBatchSize + 10)
+		if err := bs.PutMany(ctx, blks); err != nil {
+			t.Fatal(err)
+		}
+
+		// blocks from other repos must not show up
+		other := New("did:plc:other", dbw)
+		other.SetRev(testRev)
+		if err := other.Put(ctx, missing); err != nil {
+			t.Fatal(err)
+		}
+
+		// blocks that only exist in memory are included, and blocks in both places are only sent once
+		ro := NewReadOnly(testDid, dbw)
+		extra := blocks.NewBlock([]byte("in memory"))
+		if err := ro.Put(ctx, extra); err != nil {
+			t.Fatal(err)
+		}
+		if err := ro.Put(ctx, blks[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		keys := collectKeys(t, ro)
+		if len(keys) != len(blks)+1 {
+			t.Errorf("expected %d keys, got %d", len(blks)+1, len(keys))
+		}
+		for _, b := range append(blks, extra) {
+			if keys[b.Cid()] != 1 {
+				t.Errorf("expected %s to be sent once, was sent %d times", b.Cid(), keys[b.Cid()])
+			}
+		}
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		dbw := newTestDB(t)
+		ro := NewReadOnly(testDid, dbw)
+
+		// writes to a read only blockstore are kept in memory and don't need a rev
+		if err := ro.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := New(testDid, dbw).Get(ctx, blk.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected block to not be written to the database, got %v", err)
+		}
+	})
+
+	t.Run("hash on read", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dbw.Exec(ctx, "UPDATE blocks SET value = ? WHERE cid = ?", nil, []byte("corrupted"), blk.Cid().Bytes()).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		fresh := New(testDid, dbw)
+		fresh.HashOnRead(true)
+		if _, err := fresh.Get(ctx, blk.Cid()); !errors.Is(err, blocks.ErrWrongHash) {
+			t.Errorf("expected a wrong hash error, got %v", err)
+		}
+	})
+}
+
+func TestBlockstoreRevs(t *testing.T) {
+	ctx := context.Background()
+
+	blks := testBlocks(2)
+
+	t.Run("writes need a rev", func(t *testing.T) {
+		bs := New(testDid, newTestDB(t))
+
+		if err := bs.Put(ctx, blks[0]); !errors.Is(err, ErrNoRev) {
+			t.Errorf("expected ErrNoRev from put, got %v", err)
+		}
+
+		if err := bs.PutMany(ctx, blks); !errors.Is(err, ErrNoRev) {
+			t.Errorf("expected ErrNoRev from put many, got %v", err)
+		}
+	})
+
+	t.Run("blocks are tagged with the rev", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+
+		if err := bs.Put(ctx, blks[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.PutMany(ctx, blks[1:]); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range blks {
+			if rev := blockRev(t, dbw, testDid, b.Cid()); rev != testRev {
+				t.Errorf("expected %s to be tagged with %s, got %s", b.Cid(), testRev, rev)
+			}
+		}
+	})
+
+	t.Run("writing a block again updates its rev", func(t *testing.T) {
+		dbw := newTestDB(t)
+
+		first := New(testDid, dbw)
+		first.SetRev(testRev)
+		if err := first.PutMany(ctx, blks); err != nil {
+			t.Fatal(err)
+		}
+
+		const next = "3jzfcijpj2z2b"
+		second := New(testDid, dbw)
+		second.SetRev(next)
+		if err := second.Put(ctx, blks[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := second.PutMany(ctx, blks[1:]); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range blks {
+			if rev := blockRev(t, dbw, testDid, b.Cid()); rev != next {
+				t.Errorf("expected %s to be tagged with %s, got %s", b.Cid(), next, rev)
+			}
+		}
+	})
+}
+
+func TestBlockstoreCache(t *testing.T) {
+	ctx := context.Background()
+
+	blk := testBlocks(1)[0]
+
+	t.Run("reads fill the cache", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		cache := NewBlockCache(DefaultCacheSize)
+		reader := New(testDid, dbw)
+		reader.SetCache(cache, true)
+		if _, err := reader.Get(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+
+		// once the block is cached, it can be read without touching the database
+		if err := dbw.Exec(ctx, "DELETE FROM blocks", nil).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		cached := New(testDid, dbw)
+		cached.SetCache(cache, false)
+		if _, err := cached.Get(ctx, blk.Cid()); err != nil {
+			t.Errorf("expected block to be read from the cache, got %v", err)
+		}
+		if has, _ := cached.Has(ctx, blk.Cid()); !has {
+			t.Errorf("expected has to check the cache")
+		}
+		if size, _ := cached.GetSize(ctx, blk.Cid()); size != len(blk.RawData()) {
+			t.Errorf("expected get size to check the cache")
+		}
+
+		// the cache is still scoped to the repo
+		other := New("did:plc:other", dbw)
+		other.SetCache(cache, false)
+		if _, err := other.Get(ctx, blk.Cid()); !ipld.IsNotFound(err) {
+			t.Errorf("expected another repo's cached block to not be found, got %v", err)
+		}
+	})
+
+	t.Run("reads without fill leave the cache alone", func(t *testing.T) {
+		dbw := newTestDB(t)
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		cache := NewBlockCache(DefaultCacheSize)
+		reader := New(testDid, dbw)
+		reader.SetCache(cache, false)
+		if _, err := reader.Get(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := cache.Get(testDid, blk.Cid()); ok {
+			t.Errorf("expected block to not be cached")
+		}
+	})
+
+	t.Run("delete removes the block from the cache", func(t *testing.T) {
+		dbw := newTestDB(t)
+		cache := NewBlockCache(DefaultCacheSize)
+
+		bs := New(testDid, dbw)
+		bs.SetRev(testRev)
+		bs.SetCache(cache, true)
+		if err := bs.Put(ctx, blk); err != nil {
+			t.Fatal(err)
+		}
+
+		reader := New(testDid, dbw)
+		reader.SetCache(cache, true)
+		if _, err := reader.Get(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cache.Get(testDid, blk.Cid()); !ok {
+			t.Fatal("expected block to be cached")
+		}
+
+		if err := bs.DeleteBlock(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := cache.Get(testDid, blk.Cid()); ok {
+			t.Errorf("expected deleted block to be removed from the cache")
+		}
+	})
+
+	t.Run("least recently used blocks are evicted", func(t *testing.T) {
+		blks := testBlocks(5)
+		size := int64(len(blks[0].RawData()) + len(testDid) + cacheEntryOverhead)
+		cache := NewBlockCache(3 * size)
+
+		for _, b := range blks[:3] {
+			cache.Add(testDid, b)
+		}
+
+		// touching the oldest block makes the second one the next to go
+		if _, ok := cache.Get(testDid, blks[0].Cid()); !ok {
+			t.Fatal("expected block to be cached")
+		}
+		cache.Add(testDid, blks[3])
+
+		if _, ok := cache.Get(testDid, blks[1].Cid()); ok {
+			t.Errorf("expected least recently used block to be evicted")
+		}
+		for _, b := range []blocks.Block{blks[0], blks[2], blks[3]} {
+			if _, ok := cache.Get(testDid, b.Cid()); !ok {
+				t.Errorf("expected %s to still be cached", b.Cid())
+			}
+		}
+
+		stats := cache.Stats()
+		if stats.Entries != 3 || stats.Bytes != 3*size || stats.Evictions != 1 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("blocks larger than the cache are skipped", func(t *testing.T) {
+		cache := NewBlockCache(cacheEntryOverhead)
+		cache.Add(testDid, blk)
+
+		if stats := cache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+			t.Errorf("expected nothing to be cached, got %+v", stats)
+		}
+	})
+
+	t.Run("remove repo", func(t *testing.T) {
+		cache := NewBlockCache(DefaultCacheSize)
+		cache.Add(testDid, blk)
+		cache.Add("did:plc:other", blk)
+
+		cache.RemoveRepo(testDid)
+
+		if _, ok := cache.Get(testDid, blk.Cid()); ok {
+			t.Errorf("expected repo's blocks to be removed")
+		}
+		if _, ok := cache.Get("did:plc:other", blk.Cid()); !ok {
+			t.Errorf("expected other repo's blocks to be kept")
+		}
+	})
+}